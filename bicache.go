@@ -3,11 +3,14 @@
 package bicache
 
 import (
+	"container/heap"
 	"container/list"
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -17,32 +20,308 @@ import (
 	"github.com/jamiealquiza/tachymeter"
 )
 
+// lockWaitSamples is the number of most recent
+// lock wait samples used for lock wait stats.
+const lockWaitSamples = 1024
+
+// scoreSamples is the maximum number of key
+// scores sampled for StatsDetailed quantiles.
+const scoreSamples = 65536
+
+// maxEvictVetoes is the maximum number of keys
+// that CanEvict may veto in a single MRU eviction
+// pass before the pass is abandoned.
+const maxEvictVetoes = 1024
+
+// defaultFlushTimeout is the FlushOnClose
+// timeout used if Config.FlushTimeout is unset.
+const defaultFlushTimeout = 10 * time.Second
+
+// maxSize is the maximum MFU or MRU size. This
+// ensures that the total cache size, including
+// any rounding up across shards, fits in an int.
+const maxSize uint = math.MaxInt / 4
+
+// Errors returned by SetBlocking and Atomic.
+var (
+	ErrClosed   = errors.New("cache is closed")
+	ErrRejected = errors.New("value rejected")
+)
+
 // Bicache implements a two-tier MFU/MRU
 // cache with sharded cache units.
 type Bicache struct {
-	shards     []*Shard
-	autoEvict  bool
-	ShardCount uint32
-	Size       int
-	paused     uint32
-	done       context.CancelFunc
+	// lastEvictCycle is the unix nano
+	// timestamp of the last completed
+	// eviction cycle. Kept first for
+	// 64-bit atomic alignment.
+	lastEvictCycle int64
+	// cycleEvictions is the capacity evictions
+	// count at the last completed eviction cycle,
+	// and recentEvicted and recentInterval are the
+	// capacity evictions count and nanoseconds
+	// elapsed between the last two completed cycles.
+	cycleEvictions uint64
+	recentEvicted  uint64
+	recentInterval int64
+	shards         []*Shard
+	single         *Shard // Set if ShardCount is 1.
+	autoEvict      uint32
+	ShardCount     uint32
+	Size           int // Size at creation; see Stats after Reconfigure.
+	paused         uint32
+	closed         uint32
+	ctx            context.Context
+	done           context.CancelFunc
+	// config holds the applied configuration.
+	// configLock serializes changes to the
+	// config and background task.
+	config        Config
+	configLock    sync.Mutex
+	stopAutoEvict context.CancelFunc
+	// incrResetTTL specifies whether IncrTTL
+	// refreshes the TTL of an existing counter.
+	incrResetTTL  bool
+	maxValueBytes int
+	maxKeyBytes   int
+	sizer         func(interface{}) int
+	// lockWait records Get lock wait times, if
+	// enabled. The tachymeter isn't safe for
+	// concurrent AddTime and Calc calls, so
+	// it's guarded by lockWaitLock.
+	lockWait     *tachymeter.Tachymeter
+	lockWaitLock sync.Mutex
+
+	onOverCapacity func(int, int)
+	maxListResults int
+	mode           Mode
+	// marshal and unmarshal transform values
+	// to and from their stored []byte form.
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte) (interface{}, error)
+	// copyValue, if set, returns a copy
+	// of values to be stored.
+	copyValue func(interface{}) interface{}
+
+	store        Store
+	flushOnClose bool
+	flushTimeout time.Duration
+
+	history *evictionHistory
+	hooks   *hookRecovery
+	// promoteOnGet specifies whether gets
+	// move MRU keys to the MRU head.
+	promoteOnGet bool
+	clock        Clock
+
+	onOpStart func(string, string) interface{}
+	onOpEnd   func(interface{})
+
+	// debug enables entry consistency
+	// checks on gets and deletes.
+	debug bool
 }
 
 // Shard implements a cache unit
 // with isolated MFU/MRU caches.
 type Shard struct {
 	sync.RWMutex
-	cacheMap      map[string]*entry
-	mfuCache      *sll.Sll
-	mruCache      *sll.Sll
-	mfuCap        uint
-	mruCap        uint
-	autoEvict     bool
-	ttlCount      uint64
+	index     int
+	cacheMap  map[string]*entry
+	mfuCache  *sll.Sll
+	mruCache  *sll.Sll
+	mfuCap    uint
+	mruCap    uint
+	autoEvict bool
+	ttlCount  uint64
+	// ttlLock guards the ttlMap and nearestExpire
+	// so that TTL scans don't hold the shard lock.
+	// Writes require both the shard write lock and
+	// the ttlLock (acquired in that order), while
+	// reads require either.
+	ttlLock       sync.Mutex
 	ttlMap        map[string]time.Time
 	counters      *counters
 	nearestExpire time.Time
-	noOverflow    bool
+	// scanNearest is the nearest expiration
+	// set since the start of the last TTL scan.
+	scanNearest   time.Time
+	noOverflow    uint32
+	ttlJitter     time.Duration
+	onEvict       func(string, interface{})
+	initCap       int
+	evictMFUFirst bool
+	mode          Mode
+	// evictDisplaced specifies whether MFU
+	// nodes displaced by score promotions are
+	// evicted rather than demoted to the MRU.
+	evictDisplaced bool
+	// lowWatermark is the fraction of the
+	// MRU capacity that overflow is evicted
+	// down to.
+	lowWatermark float64
+	// overflowGrace is the multiple of the
+	// MRU capacity that the MRU may grow to
+	// before overflow is promoted/evicted.
+	overflowGrace float64
+	// promoteOnTie specifies whether MRU nodes
+	// displace MFU nodes with equal scores.
+	promoteOnTie bool
+	// overflowEvict specifies whether inserts
+	// into a full shard evict the LRU key inline.
+	overflowEvict bool
+	// canEvict, if set, may veto
+	// MRU capacity evictions.
+	canEvict func(string, interface{}) bool
+	// prioritized is the number of entries
+	// with a non-zero priority. Evictions only
+	// consider priorities if it's non-zero.
+	prioritized int
+	// history records recent evictions, if
+	// Config.EvictionHistory is set.
+	history *evictionHistory
+	// hooks recovers panics in user hooks.
+	hooks *hookRecovery
+	// clock is the time source for TTLs.
+	clock Clock
+	// space is closed and replaced (see signalSpace)
+	// to wake sets waiting in SetBlocking when keys
+	// are removed from the shard. waiting is the number
+	// of waiting sets; it's only changed with the shard
+	// locked, but may be read atomically without it.
+	space   chan struct{}
+	waiting uint32
+	// entries pools removed entries, along
+	// with their nodes and cacheData, to be
+	// reused by inserts.
+	entries sync.Pool
+	// rng is the shard's random source, used
+	// so that randomized operations on different
+	// shards don't contend on the global source.
+	// rngLock guards rng.
+	rngLock sync.Mutex
+	rng     *rand.Rand
+	// loads tracks in-flight GetOrLoad loader
+	// calls by key. It's allocated on first use.
+	loads map[string]*loadCall
+	// onEvictBatch, if set, is called with the
+	// entries evicted while the shard was locked
+	// (collected in evicted) once it's unlocked.
+	onEvictBatch func([]EvictedEntry)
+	evicted      []EvictedEntry
+}
+
+// Unlock write unlocks the shard. If an OnEvictBatch
+// hook is set, it's then called with any entries
+// evicted while the shard was locked, so that the
+// hook runs outside of the shard lock.
+func (s *Shard) Unlock() {
+	evicted := s.evicted
+	s.evicted = nil
+
+	s.RWMutex.Unlock()
+
+	if len(evicted) > 0 {
+		s.hooks.call("OnEvictBatch", func() { s.onEvictBatch(evicted) })
+	}
+}
+
+// Eviction reasons recorded in
+// an EvictionRecord.
+const (
+	EvictReasonCapacity = "capacity"
+	EvictReasonTTL      = "ttl"
+)
+
+// EvictedEntry is a key and value
+// passed to Config.OnEvictBatch.
+type EvictedEntry struct {
+	Key    string
+	Value  interface{}
+	Reason string
+}
+
+// EvictionRecord is a record of
+// a key eviction.
+type EvictionRecord struct {
+	Key    string
+	Reason string
+	Time   time.Time
+}
+
+// hookRecovery recovers and counts panics
+// in user hooks. It's shared by all shards.
+type hookRecovery struct {
+	panics uint64
+	// all specifies whether panics in hooks
+	// called outside of the shard lock are
+	// recovered (Config.RecoverHooks).
+	all bool
+}
+
+// call calls fn, a hook called outside of the
+// shard lock. If Config.RecoverHooks is set, a
+// panic in fn is recovered as in callLocked.
+func (h *hookRecovery) call(hook string, fn func()) {
+	if !h.all {
+		fn()
+		return
+	}
+
+	h.callLocked(hook, fn)
+}
+
+// callLocked calls fn, a hook called with the
+// shard locked. A panic in fn is always recovered,
+// counted and logged rather than propagated, since
+// it would otherwise leave the shard locked; hook
+// names the hook that fn calls.
+func (h *hookRecovery) callLocked(hook string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&h.panics, 1)
+			log.Printf("[Bicache] Recovered panic in %s hook: %v\n", hook, r)
+		}
+	}()
+
+	fn()
+}
+
+// evictionHistory is a fixed size ring
+// buffer of the most recent evictions.
+type evictionHistory struct {
+	sync.Mutex
+	records []EvictionRecord
+	next    int
+	full    bool
+}
+
+// add records r, overwriting the
+// oldest record if the buffer is full.
+func (h *evictionHistory) add(r EvictionRecord) {
+	h.Lock()
+	h.records[h.next] = r
+	h.next++
+	if h.next == len(h.records) {
+		h.next = 0
+		h.full = true
+	}
+	h.Unlock()
+}
+
+// list returns a copy of the
+// records from oldest to newest.
+func (h *evictionHistory) list() []EvictionRecord {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.full {
+		return append([]EvictionRecord(nil), h.records[:h.next]...)
+	}
+
+	records := make([]EvictionRecord, 0, len(h.records))
+	records = append(records, h.records[h.next:]...)
+	return append(records, h.records[:h.next]...)
 }
 
 // Counters holds Bicache performance
@@ -50,8 +329,129 @@ type Shard struct {
 type counters struct {
 	hits      uint64
 	misses    uint64
+	sets      uint64
 	evictions uint64
 	overflows uint64
+	tooLarge  uint64
+	tooLong   uint64
+	closed    uint64
+	// deferredOverflows counts new keys
+	// accepted into full shards, to be
+	// evicted by the background task.
+	deferredOverflows uint64
+	// Capacity evictions by tier.
+	mfuEvictions uint64
+	mruEvictions uint64
+}
+
+// Operation names passed to
+// the OnOpStart hook.
+const (
+	OpGet    = "get"
+	OpSet    = "set"
+	OpSetTTL = "setttl"
+	OpDel    = "del"
+)
+
+// Mode specifies a Bicache cache policy.
+type Mode uint8
+
+const (
+	// ModeDefault is the hybrid MFU/MRU policy.
+	ModeDefault Mode = iota
+	// ModeLRU is a pure LRU policy. There's no
+	// MFU and overflow keys are evicted from the
+	// MRU tail at each set, bypassing all score
+	// based promotion and eviction.
+	ModeLRU
+	// ModeStrictLRU is ModeLRU without scoring.
+	// Gets move keys to the MRU head (taking the
+	// shard write lock) rather than incrementing
+	// key scores, giving textbook LRU eviction.
+	ModeStrictLRU
+	// ModeFIFO is a pure FIFO policy. There's no
+	// MFU, keys aren't scored, and neither gets nor
+	// updates reorder keys, so overflow keys are
+	// evicted from the MRU tail at each set in
+	// insertion order.
+	ModeFIFO
+)
+
+// mruOnly returns whether or not m is an LRU
+// or FIFO mode, where there's no MFU and overflow
+// is evicted from the MRU tail at each set.
+func (m Mode) mruOnly() bool {
+	return m == ModeLRU || m == ModeStrictLRU || m == ModeFIFO
+}
+
+// scored returns whether or not
+// gets increment key scores in m.
+func (m Mode) scored() bool {
+	return m != ModeStrictLRU && m != ModeFIFO
+}
+
+// Store is a backing store that cache
+// entries can be saved to. Save should return
+// once ctx is done.
+type Store interface {
+	Save(ctx context.Context, entries []WarmEntry) error
+}
+
+// Clock provides the current time
+// for TTL expirations.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default
+// Clock, using time.Now.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// CacheReader is the read only subset of
+// the Bicache methods. See ReadOnly.
+type CacheReader interface {
+	Get(k string) interface{}
+	GetBytesKey(k []byte) interface{}
+	MultiGet(keys []string) []interface{}
+	ExistsMulti(keys []string) []bool
+	GetMultiStale(keys []string) map[string]StaleValue
+	GetMeta(k string) (interface{}, bool)
+	State(k string) (uint8, bool)
+	List(n int) ListResults
+	HotKeys(n int) []KeyInfo
+	KeysOfType(sample interface{}) []string
+	ExpiringWithin(d time.Duration) []KeyInfo
+	RandomKey() (string, bool)
+	Dump() map[string]interface{}
+	DumpN(n int) map[string]interface{}
+	Snapshot() []WarmEntry
+	Stats() *Stats
+	StatsDelta(prev *Stats) *StatsDelta
+	StatsDetailed() *DetailedStats
+	WarmRatio() float64
+	IsWarm(threshold float64) bool
+	RecentEvictions() []EvictionRecord
+}
+
+// readOnly wraps a CacheReader so that only
+// the CacheReader methods are promoted and the
+// *Bicache can't be recovered by type assertion.
+type readOnly struct {
+	CacheReader
+}
+
+// ReadOnly returns a CacheReader view of the cache,
+// exposing only the read operations, e.g. for passing
+// to components that should consume the cache without
+// being able to modify it. The view is backed by b;
+// no data is copied. Reads through the view update
+// key scores and stats as usual.
+func (b *Bicache) ReadOnly() CacheReader {
+	return readOnly{b}
 }
 
 // Config holds a Bicache configuration.
@@ -61,7 +461,8 @@ type counters struct {
 // goroutine will handle MRU->MFU promotion
 // and MFU/MRU evictions. Setting this to 0
 // defers the operation until each Set is called
-// on the bicache.
+// on the bicache, and expired keys are instead
+// evicted lazily when read.
 type Config struct {
 	MFUSize    uint
 	MRUSize    uint
@@ -70,6 +471,158 @@ type Config struct {
 	ShardCount int
 	NoOverflow bool
 	Context    context.Context
+	// IncrResetTTL specifies whether IncrTTL resets
+	// the TTL of an existing counter. By default, the
+	// existing TTL is preserved.
+	IncrResetTTL bool
+	// TTLJitter adds a random duration in the range
+	// [0, TTLJitter) to each TTL set, spreading out the
+	// expiration of keys set with the same TTL.
+	TTLJitter time.Duration
+	// OnEvict, if set, is called with the key and value
+	// of each key evicted by capacity or TTL. It's called
+	// while the shard is locked and must not call back
+	// into the cache.
+	OnEvict func(k string, v interface{})
+	// InitialCapacity is a hint for the number of keys
+	// to preallocate space for across all shards. If
+	// unset, space is preallocated for the full cache
+	// capacity.
+	InitialCapacity uint
+	// MaxValueBytes, if set, causes sets with values
+	// larger than MaxValueBytes to be rejected.
+	MaxValueBytes int
+	// Sizer measures values for MaxValueBytes. If unset,
+	// []byte and string values are measured by length
+	// and all other types are admitted.
+	Sizer func(v interface{}) int
+	// LockWaitStats enables recording the time that
+	// Get calls spend waiting on shard locks, reported
+	// in Stats.
+	LockWaitStats bool
+	// EvictMFUFirst changes the overflow eviction
+	// policy to evict the lowest score MFU keys
+	// (promoting MRU keys in their place) before
+	// evicting from the MRU tail.
+	EvictMFUFirst bool
+	// EvictDisplaced causes MFU keys displaced by
+	// higher score MRU keys to be evicted, rather
+	// than demoted to the MRU head.
+	EvictDisplaced bool
+	// PromoteOnTie causes MRU keys to displace MFU
+	// keys with equal scores, favoring recency as a
+	// tiebreaker. By default, an MRU key must have a
+	// strictly higher score.
+	PromoteOnTie bool
+	// OnOverCapacity, if set, is called after a set
+	// when AutoEvict is enabled and the shard is left
+	// over capacity, with the shard index and the
+	// count of keys over capacity.
+	OnOverCapacity func(shard int, overBy int)
+	// Mode sets the cache policy
+	// (defaults to ModeDefault).
+	Mode Mode
+	// Marshal and Unmarshal, if set, serialize values
+	// to []byte on set and deserialize them on get.
+	// Both must be set together.
+	Marshal   func(v interface{}) ([]byte, error)
+	Unmarshal func(b []byte) (interface{}, error)
+	// OverflowEvict causes sets of new keys into a full
+	// shard to synchronously evict the LRU key (or the
+	// lowest score key in MFU-only caches) to make room,
+	// keeping the cache strictly bounded between eviction
+	// cycles. It's mutually exclusive with NoOverflow.
+	OverflowEvict bool
+	// Store sets a backing Store.
+	Store Store
+	// FlushOnClose causes Close to save all entries
+	// to the Store, waiting at most FlushTimeout
+	// (defaults to 10 seconds).
+	FlushOnClose bool
+	FlushTimeout time.Duration
+	// EvictionHistory, if set, is the number of most
+	// recent evictions to record for RecentEvictions.
+	EvictionHistory int
+	// PromoteOnGet causes gets to move MRU keys to the
+	// MRU head, making MRU recency driven by reads as
+	// well as writes. This requires gets to take shard
+	// write locks, reducing read throughput.
+	PromoteOnGet bool
+	// Clock sets the time source used for TTLs
+	// (defaults to the system clock), allowing tests
+	// to control time.
+	Clock Clock
+	// CopyOnSet causes sets to store a copy of the
+	// value made with CopyFunc, so that callers mutating
+	// a value after setting it don't affect the cached
+	// value. If CopyFunc is unset, []byte values are
+	// copied and all other types are stored as-is.
+	// CopyOnSet has no effect when Marshal is set, since
+	// the marshaled form is already a copy.
+	CopyOnSet bool
+	CopyFunc  func(v interface{}) interface{}
+	// OnOpStart and OnOpEnd, if set, are called at the
+	// start and end of each Get, Set, SetTTL and Del call
+	// (e.g. for tracing). OnOpStart is called with the
+	// operation name (one of the Op constants) and key,
+	// and the token it returns is passed to OnOpEnd.
+	OnOpStart func(op, key string) interface{}
+	OnOpEnd   func(token interface{})
+	// LowWatermark, if set, is the fraction of the MRU
+	// capacity in the range (0, 1] that an over capacity
+	// MRU is promoted/evicted down to, rather than exactly
+	// to capacity (the default, 1). This batches evictions
+	// into fewer, larger passes on a steadily filling cache.
+	LowWatermark float64
+	// MaxListResults, if set, caps the number of keys
+	// that List considers and returns, bounding the cost
+	// of List calls with large n.
+	MaxListResults int
+	// Debug enables a consistency check on each Get and
+	// Del, logging keys whose entry state disagrees with
+	// the list their node is linked in. It's intended for
+	// diagnosing promotion/eviction bugs.
+	Debug bool
+	// OverflowGrace, if set, is a multiple of the MRU
+	// capacity (>= 1) that the MRU may grow to before
+	// promotions/evictions are triggered, tolerating short
+	// bursts over capacity. Once exceeded, the MRU is
+	// evicted back down to capacity (or LowWatermark).
+	// Defaults to 1.
+	OverflowGrace float64
+	// Seed, if set, seeds the random source of each shard
+	// (used for TTL jitter and sampling), making randomized
+	// behavior reproducible, e.g. for tests. Each shard's
+	// source is seeded distinctly. By default, the sources
+	// are seeded from the current time.
+	Seed int64
+	// MaxKeyBytes, if set, causes sets of keys
+	// longer than MaxKeyBytes to be rejected.
+	MaxKeyBytes int
+	// CanEvict, if set, is called with the key and value
+	// of each MRU key selected for capacity eviction. If
+	// it returns false, the key is skipped and the next
+	// coldest key is evicted instead. At most 1024 keys
+	// are skipped per eviction pass. Like OnEvict, it's
+	// called while the shard is locked and must not call
+	// back into the cache. A panicking CanEvict doesn't
+	// veto the eviction.
+	CanEvict func(key string, value interface{}) bool
+	// OnEvictBatch, if set, is called with the keys, values
+	// and reasons of the keys evicted from a shard while it
+	// was locked (e.g. in an eviction cycle), once the shard
+	// is unlocked. This amortizes the hook cost and keeps it
+	// out of the shard lock; other shards may still be locked,
+	// and it must not call back into the cache.
+	OnEvictBatch func(evicted []EvictedEntry)
+	// RecoverHooks recovers panics in the OnEvictBatch
+	// and OnOverCapacity hooks and in Store saves, so that
+	// a faulty hook can't crash the process. A panicking
+	// Store save fails with an error. Panics in OnEvict
+	// and CanEvict, which are called while a shard is
+	// locked, are always recovered. Recovered panics are
+	// logged and counted in Stats.HookPanics.
+	RecoverHooks bool
 }
 
 // Entry is a container type for scored
@@ -77,8 +630,10 @@ type Config struct {
 // in the Bicache cache map and are used to
 // locate which cache a lookup should hit.
 type entry struct {
-	node  *sll.Node
-	state uint8 // 0 = MRU, 1 = MFU
+	node    *sll.Node
+	state   uint8       // 0 = MRU, 1 = MFU
+	version uint64      // Set through SetIfNewer.
+	meta    interface{} // Set through SetMeta.
 }
 
 // cacheData is the data container
@@ -87,6 +642,39 @@ type entry struct {
 type cacheData struct {
 	k string
 	v interface{}
+	// priority is set through SetWithPriority. It's
+	// kept with the node so that eviction candidates
+	// are ordered without cache map lookups.
+	priority int
+}
+
+// reclaimedValue replaces the value of
+// keys reclaimed with Reclaim. The key and
+// its metadata are retained, but gets of
+// the key are misses until it's set again.
+type reclaimedValue struct{}
+
+// reclaimed returns whether or not the
+// entry's value has been reclaimed.
+func (e *entry) reclaimed() bool {
+	_, ok := e.node.Value.(*cacheData).v.(reclaimedValue)
+	return ok
+}
+
+// value returns the entry's value, or
+// nil if the value has been reclaimed.
+func (e *entry) value() interface{} {
+	if e.reclaimed() {
+		return nil
+	}
+
+	return e.node.Value.(*cacheData).v
+}
+
+// priority returns the entry's priority
+// (see SetWithPriority).
+func (e *entry) priority() int {
+	return e.node.Value.(*cacheData).priority
 }
 
 // Stats holds Bicache
@@ -100,20 +688,114 @@ type Stats struct {
 	MRUMaxSize uint   // Maximum number of MRU keys.
 	Hits       uint64 // Cache hits.
 	Misses     uint64 // Cache misses.
+	Sets       uint64 // Successful sets.
 	Evictions  uint64 // Cache evictions.
 	Overflows  uint64 // Failed sets on full caches.
+	TooLarge   uint64 // Failed sets for values exceeding the max size.
+	TooLong    uint64 // Failed sets for keys exceeding the max length.
+	Closed     uint64 // Failed sets on closed caches.
+	Rejections uint64 // Total failed sets.
+	TTLKeys    uint64 // Number of keys with a TTL.
+	// Capacity evictions from the MFU and MRU.
+	MFUEvictions uint64
+	MRUEvictions uint64
+	// New keys accepted into full caches
+	// while AutoEvict is enabled, to be
+	// evicted in a later eviction cycle.
+	DeferredOverflows uint64
+	// Capacity evictions per second between
+	// the last two eviction cycles.
+	EvictionRate float64
+	// Shard lock wait times for Get calls,
+	// if Config.LockWaitStats is enabled.
+	LockWaitP50 time.Duration
+	LockWaitP99 time.Duration
+	// Whether evictions are paused (see Pause).
+	Paused bool
+	// Hook panics recovered (see
+	// Config.RecoverHooks).
+	HookPanics uint64
+	// Time the stats were captured.
+	Time time.Time
+}
+
+// StatsDelta holds per second rates
+// computed from the difference between
+// a previous Stats and the current Stats.
+type StatsDelta struct {
+	Interval  time.Duration // Time elapsed since the previous Stats.
+	Hits      float64       // Cache hits per second.
+	Misses    float64       // Cache misses per second.
+	Evictions float64       // Cache evictions per second.
+	Sets      float64       // Successful sets per second.
+}
+
+// DetailedStats holds Stats along with
+// statistics that require scanning keys.
+type DetailedStats struct {
+	Stats
+	ColdKeys    uint64 // Number of keys that have never been read.
+	MedianScore uint64 // Median key score.
+	P99Score    uint64 // 99th percentile key score.
 }
 
 // New takes a *Config and returns
 // an initialized *Bicache.
 func New(c *Config) (*Bicache, error) {
+	if c == nil {
+		return nil, errors.New("Config must not be nil")
+	}
+
 	// Check that ShardCount is a power of 2.
-	if (c.ShardCount & (c.ShardCount - 1)) != 0 {
+	if c.ShardCount < 0 || (c.ShardCount&(c.ShardCount-1)) != 0 {
 		return nil, errors.New("Shard count must be a power of 2")
 	}
 
-	if c.MRUSize <= 0 {
-		return nil, errors.New("MRU size must be > 0")
+	// An MRU size of 0 is allowed for
+	// MFU-only (LFU) caches.
+	if c.MRUSize <= 0 && c.MFUSize <= 0 {
+		return nil, errors.New("MFU or MRU size must be > 0")
+	}
+
+	if c.MFUSize > maxSize || c.MRUSize > maxSize || c.InitialCapacity > maxSize {
+		return nil, fmt.Errorf("MFU, MRU and initial capacity sizes must be <= %d", maxSize)
+	}
+
+	// LRU and FIFO modes have no MFU.
+	if c.Mode.mruOnly() {
+		if c.MRUSize <= 0 {
+			return nil, errors.New("MRU size must be > 0 in LRU and FIFO modes")
+		}
+		c.MFUSize = 0
+	}
+
+	if (c.Marshal == nil) != (c.Unmarshal == nil) {
+		return nil, errors.New("Marshal and Unmarshal must be set together")
+	}
+
+	if c.NoOverflow && c.OverflowEvict {
+		return nil, errors.New("NoOverflow and OverflowEvict are mutually exclusive")
+	}
+
+	if c.LowWatermark < 0 || c.LowWatermark > 1 {
+		return nil, errors.New("Low watermark must be in the range (0, 1]")
+	}
+
+	// Default to evicting
+	// down to capacity.
+	if c.LowWatermark == 0 {
+		c.LowWatermark = 1
+	}
+
+	if c.OverflowGrace != 0 && c.OverflowGrace < 1 {
+		return nil, errors.New("Overflow grace must be >= 1")
+	}
+
+	// Default to evicting as
+	// soon as the MRU is over
+	// capacity.
+	if c.OverflowGrace == 0 {
+		c.OverflowGrace = 1
 	}
 
 	// Default to 512 if unset.
@@ -124,22 +806,72 @@ func New(c *Config) (*Bicache, error) {
 	shards := make([]*Shard, c.ShardCount)
 
 	// Get cache sizes for each shard.
-	mfuSize := int(math.Ceil(float64(c.MFUSize) / float64(c.ShardCount)))
-	mruSize := int(math.Ceil(float64(c.MRUSize) / float64(c.ShardCount)))
+	mfuSize := shardSize(c.MFUSize, c.ShardCount)
+	mruSize := shardSize(c.MRUSize, c.ShardCount)
+
+	// Get the initial cache map capacity
+	// for each shard. Defaults to preallocating
+	// the full shard capacity.
+	initCap := mfuSize + mruSize
+	if c.InitialCapacity > 0 {
+		initCap = shardSize(c.InitialCapacity, c.ShardCount)
+	}
+
+	clock := c.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	// Shard random sources are seeded
+	// distinctly from the base seed.
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// The eviction history is
+	// shared by all shards.
+	var history *evictionHistory
+	if c.EvictionHistory > 0 {
+		history = &evictionHistory{
+			records: make([]EvictionRecord, c.EvictionHistory),
+		}
+	}
+
+	hooks := &hookRecovery{all: c.RecoverHooks}
 
 	// Init shards.
 	for i := 0; i < c.ShardCount; i++ {
 		shards[i] = &Shard{
-			cacheMap:      make(map[string]*entry, mfuSize+mruSize),
-			mfuCache:      sll.New(),
+			index:         i,
+			cacheMap:      make(map[string]*entry, initCap),
+			mfuCache:      newMFU(uint(mfuSize)),
 			mruCache:      sll.New(),
 			mfuCap:        uint(mfuSize),
 			mruCap:        uint(mruSize),
 			ttlMap:        make(map[string]time.Time),
 			counters:      &counters{},
-			nearestExpire: time.Now(),
-			noOverflow:    c.NoOverflow,
+			nearestExpire: clock.Now(),
+			ttlJitter:     c.TTLJitter,
+			onEvict:       c.OnEvict,
+			initCap:       initCap,
+			evictMFUFirst: c.EvictMFUFirst,
+
+			evictDisplaced: c.EvictDisplaced,
+			promoteOnTie:   c.PromoteOnTie,
+			lowWatermark:   c.LowWatermark,
+			overflowGrace:  c.OverflowGrace,
+			mode:           c.Mode,
+			overflowEvict:  c.OverflowEvict,
+			canEvict:       c.CanEvict,
+			onEvictBatch:   c.OnEvictBatch,
+			space:          make(chan struct{}),
+			history:        history,
+			hooks:          hooks,
+			clock:          clock,
+			rng:            rand.New(rand.NewSource(seed + int64(i))),
 		}
+		shards[i].setNoOverflow(c.NoOverflow)
 	}
 
 	if c.Context == nil {
@@ -151,38 +883,275 @@ func New(c *Config) (*Bicache, error) {
 		shards:     shards,
 		ShardCount: uint32(c.ShardCount),
 		Size:       (mfuSize + mruSize) * c.ShardCount,
+		ctx:        ctx,
 		done:       cf,
+		config:     *c,
+
+		incrResetTTL:  c.IncrResetTTL,
+		maxValueBytes: c.MaxValueBytes,
+		maxKeyBytes:   c.MaxKeyBytes,
+		sizer:         c.Sizer,
+
+		onOverCapacity: c.OnOverCapacity,
+		maxListResults: c.MaxListResults,
+		mode:           c.Mode,
+
+		marshal:   c.Marshal,
+		unmarshal: c.Unmarshal,
+
+		store:        c.Store,
+		flushOnClose: c.FlushOnClose,
+		flushTimeout: c.FlushTimeout,
+
+		history:      history,
+		hooks:        hooks,
+		promoteOnGet: (c.PromoteOnGet || c.Mode == ModeStrictLRU) && c.Mode != ModeFIFO,
+		clock:        clock,
+
+		onOpStart: c.OnOpStart,
+		onOpEnd:   c.OnOpEnd,
+
+		debug: c.Debug,
+	}
+
+	if c.CopyOnSet && c.Marshal == nil {
+		cache.copyValue = c.CopyFunc
+		if cache.copyValue == nil {
+			cache.copyValue = copyBytes
+		}
+	}
+
+	if cache.flushTimeout <= 0 {
+		cache.flushTimeout = defaultFlushTimeout
+	}
+
+	if c.ShardCount == 1 {
+		cache.single = shards[0]
+	}
+
+	if c.LockWaitStats {
+		cache.lockWait = tachymeter.New(&tachymeter.Config{Size: lockWaitSamples})
 	}
 
 	// Initialize a background goroutine
 	// for handling promotions and evictions,
 	// if configured.
-	if c.AutoEvict > 0 {
-		cache.autoEvict = true
-		iter := time.Duration(c.AutoEvict) * time.Millisecond
-		go bgAutoEvict(ctx, cache, iter, c)
-	}
+	cache.startAutoEvict()
 
 	return cache, nil
 }
 
+// startAutoEvict starts the background promotion and
+// eviction task if AutoEvict is configured. Any existing
+// background task is stopped first.
+func (b *Bicache) startAutoEvict() {
+	if b.stopAutoEvict != nil {
+		b.stopAutoEvict()
+		b.stopAutoEvict = nil
+	}
+
+	if b.config.AutoEvict == 0 {
+		atomic.StoreUint32(&b.autoEvict, 0)
+		b.setShardAutoEvict(false)
+		return
+	}
+
+	ctx, cf := context.WithCancel(b.ctx)
+	b.stopAutoEvict = cf
+	atomic.StoreUint32(&b.autoEvict, 1)
+	b.setShardAutoEvict(true)
+
+	// The task gets its own copy of
+	// the config since it may be changed
+	// through Reconfigure.
+	c := b.config
+	iter := time.Duration(c.AutoEvict) * time.Millisecond
+	go bgAutoEvict(ctx, b, iter, &c)
+}
+
+// setShardAutoEvict sets whether or not
+// each shard's promotions and evictions
+// are handled by the background task.
+func (b *Bicache) setShardAutoEvict(autoEvict bool) {
+	for _, s := range b.shards {
+		s.Lock()
+		s.autoEvict = autoEvict
+		s.Unlock()
+	}
+}
+
+// autoEvicting returns whether or not
+// promotions and evictions are being handled
+// by the background task.
+func (b *Bicache) autoEvicting() bool {
+	return atomic.LoadUint32(&b.autoEvict) == 1
+}
+
+// lazyExpiry returns whether or not gets should
+// evict expired keys. This is the case when TTL
+// expirations aren't handled by the background
+// task and evictions aren't paused.
+func (b *Bicache) lazyExpiry() bool {
+	return !b.autoEvicting() && atomic.LoadUint32(&b.paused) == 0
+}
+
+// Reconfigure applies changes from c to a running
+// *Bicache. The MFU/MRU sizes, NoOverflow, AutoEvict
+// and EvictLog settings are applied; a changed AutoEvict
+// or EvictLog setting restarts the background eviction
+// task. Shrinking cache sizes takes effect at the next
+// promotion/eviction; MFU keys over a reduced MFU
+// size are demoted to the MRU. Disabling the MRU moves
+// its keys to the MFU, where any overflow is evicted
+// at the next eviction. In LRU and FIFO modes,
+// the MFU size is ignored. An error is returned if c
+// specifies a different shard count, invalid cache
+// sizes or NoOverflow on an OverflowEvict cache. All
+// other settings are ignored.
+func (b *Bicache) Reconfigure(c *Config) error {
+	if c == nil {
+		return errors.New("Config must not be nil")
+	}
+
+	if c.ShardCount != 0 && uint32(c.ShardCount) != b.ShardCount {
+		return errors.New("Shard count can't be changed")
+	}
+
+	if c.MRUSize <= 0 && c.MFUSize <= 0 {
+		return errors.New("MFU or MRU size must be > 0")
+	}
+
+	if c.MFUSize > maxSize || c.MRUSize > maxSize {
+		return fmt.Errorf("MFU and MRU sizes must be <= %d", maxSize)
+	}
+
+	// LRU and FIFO modes have no MFU.
+	mfuTotal := c.MFUSize
+	if b.mode.mruOnly() {
+		if c.MRUSize <= 0 {
+			return errors.New("MRU size must be > 0 in LRU and FIFO modes")
+		}
+		mfuTotal = 0
+	}
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	if c.NoOverflow && b.config.OverflowEvict {
+		return errors.New("NoOverflow and OverflowEvict are mutually exclusive")
+	}
+
+	// Get cache sizes for each shard.
+	mfuSize := shardSize(mfuTotal, int(b.ShardCount))
+	mruSize := shardSize(c.MRUSize, int(b.ShardCount))
+
+	for _, s := range b.shards {
+		s.Lock()
+		s.mfuCap = uint(mfuSize)
+		s.mruCap = uint(mruSize)
+		// Allocate the MFU if it was
+		// previously disabled.
+		if s.mfuCache == nil {
+			s.mfuCache = newMFU(s.mfuCap)
+		}
+		// MFU-only caches evict the MFU overflow
+		// at the next eviction. Otherwise, it's
+		// demoted to the MRU to be promoted or
+		// evicted from there.
+		if s.mruCap > 0 {
+			s.demoteMFUOverflow()
+		} else {
+			s.promoteMRU()
+		}
+		// Wake blocked sets in
+		// case capacity was raised.
+		s.signalSpace()
+		s.setNoOverflow(c.NoOverflow)
+		s.Unlock()
+	}
+
+	b.config.MFUSize = mfuTotal
+	b.config.MRUSize = c.MRUSize
+	b.config.NoOverflow = c.NoOverflow
+
+	if c.AutoEvict != b.config.AutoEvict || c.EvictLog != b.config.EvictLog {
+		b.config.AutoEvict = c.AutoEvict
+		b.config.EvictLog = c.EvictLog
+		b.startAutoEvict()
+	}
+
+	return nil
+}
+
+// CloneEmpty returns a new, empty *Bicache created
+// with the configuration of b, including any changes
+// applied through Reconfigure. The new cache has its
+// own background eviction task and shares nothing with
+// b other than the values of config fields (such as the
+// Context, hooks, Clock and Store). An error is returned
+// if the configuration is no longer valid for New.
+func (b *Bicache) CloneEmpty() (*Bicache, error) {
+	b.configLock.Lock()
+	c := b.config
+	b.configLock.Unlock()
+
+	return New(&c)
+}
+
 // Close stops background tasks and
 // releases any resources. This should be
 // called before removing a reference to
 // a *Bicache if it's desired to be garbage
-// collected cleanly.
+// collected cleanly. Any sets made after
+// Close is called are rejected. If a Store and
+// FlushOnClose are configured, all entries are
+// saved to the Store before Close returns.
 func (b *Bicache) Close() {
+	atomic.StoreUint32(&b.closed, 1)
+
+	if b.store != nil && b.flushOnClose {
+		if err := b.flushToStore(); err != nil {
+			log.Printf("[Bicache] Error flushing to store: %s\n", err)
+		}
+	}
+
 	b.done()
 }
 
+// flushToStore saves a snapshot of all entries
+// to the configured Store, returning an error if
+// the save fails or doesn't complete within the
+// flush timeout.
+func (b *Bicache) flushToStore() error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.flushTimeout)
+	defer cancel()
+
+	entries := b.Snapshot()
+
+	// Save in the background so that
+	// a Store that ignores ctx can't
+	// block Close indefinitely.
+	errs := make(chan error, 1)
+	go func() {
+		err := errors.New("Store save panicked")
+		b.hooks.call("Store", func() { err = b.store.Save(ctx, entries) })
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // bgAutoEvict calls evictTTL and promoteEvict for all shards
 // sequentially on the configured iter time interval.
 func bgAutoEvict(ctx context.Context, b *Bicache, iter time.Duration, c *Config) {
 	ttlTachy := tachymeter.New(&tachymeter.Config{Size: c.ShardCount})
 	promoTachy := tachymeter.New(&tachymeter.Config{Size: c.ShardCount})
 	interval := time.NewTicker(iter)
-	var evicted int
-	var start time.Time
 
 	defer interval.Stop()
 
@@ -205,32 +1174,7 @@ func bgAutoEvict(ctx context.Context, b *Bicache, iter time.Duration, c *Config)
 			// On the auto eviction interval,
 			// we loop through each shard
 			// and trigger a TTL and promotion/eviction.
-			for _, s := range b.shards {
-				// Run ttl evictions.
-				start = time.Now()
-				evicted = 0
-
-				// At the very first check, nearestExpire
-				// was set to the Bicache initialization time.
-				// This is certain to run at least once.
-				// The first and real nearest expire will be set
-				// in any SetTTL call that's made.
-				if s.nearestExpire.Before(start.Add(iter)) {
-					evicted = s.evictTTL()
-				}
-
-				if c.EvictLog && evicted > 0 {
-					ttlTachy.AddTime(time.Since(start))
-				}
-
-				// Run promotions/overflow evictions.
-				start = time.Now()
-				s.promoteEvict()
-
-				if c.EvictLog {
-					promoTachy.AddTime(time.Since(start))
-				}
-			}
+			b.evictCycle(iter, ttlTachy, promoTachy, c.EvictLog)
 
 			// Calc eviction/promo stats.
 			ttlStats = ttlTachy.Calc()
@@ -244,9 +1188,12 @@ func bgAutoEvict(ctx context.Context, b *Bicache, iter time.Duration, c *Config)
 						ttlStats.Time.Cumulative, ttlStats.Time.Min, ttlStats.Time.Max)
 				}
 
-				// Log PromoteEvict stats.
-				log.Printf("[Bicache PromoteEvict] cumulative: %s | min: %s | max: %s\n",
-					promoStats.Time.Cumulative, promoStats.Time.Min, promoStats.Time.Max)
+				// Log PromoteEvict stats if any
+				// promotions or evictions occurred.
+				if promoStats.Count > 0 {
+					log.Printf("[Bicache PromoteEvict] cumulative: %s | min: %s | max: %s\n",
+						promoStats.Time.Cumulative, promoStats.Time.Min, promoStats.Time.Max)
+				}
 			}
 
 			// Reset tachymeter.
@@ -256,31 +1203,220 @@ func bgAutoEvict(ctx context.Context, b *Bicache, iter time.Duration, c *Config)
 	}
 }
 
+// evictCycle calls evictTTL and promoteEvict for all
+// shards sequentially. TTL evictions are run for shards
+// with a nearest expire within the iter interval. If
+// evictLog is true, timings are recorded in the ttlTachy
+// and promoTachy tachymeters. Panics are recovered and
+// logged so that a single failed cycle doesn't stop
+// the background eviction task. Hooks called with a
+// shard locked recover their own panics, so a panic
+// recovered here (e.g. from OnEvictBatch) doesn't
+// leave a shard locked. The last eviction cycle
+// timestamp is only updated if the cycle completes.
+func (b *Bicache) evictCycle(iter time.Duration, ttlTachy, promoTachy *tachymeter.Tachymeter, evictLog bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[Bicache] Recovered from panic in eviction cycle: %v\n", r)
+		}
+	}()
+
+	var evicted int
+	var start time.Time
+
+	for _, s := range b.shards {
+		// Run ttl evictions.
+		start = time.Now()
+		evicted = 0
+
+		// At the very first check, nearestExpire
+		// was set to the Bicache initialization time.
+		// This is certain to run at least once.
+		// The first and real nearest expire will be set
+		// in any SetTTL call that's made.
+		if s.expiresBefore(s.clock.Now().Add(iter)) {
+			evicted = s.evictTTL()
+		}
+
+		if evictLog && evicted > 0 {
+			ttlTachy.AddTime(time.Since(start))
+		}
+
+		// Run promotions/overflow evictions.
+		// Only record timings for shards where
+		// promotions or evictions occurred.
+		start = time.Now()
+		active := s.promoteEvict()
+		s.makeRoom()
+
+		if evictLog && active {
+			promoTachy.AddTime(time.Since(start))
+		}
+	}
+
+	b.recordCycle()
+}
+
+// recordCycle updates the last eviction cycle
+// timestamp and the count of evictions that
+// occurred since the previous cycle.
+func (b *Bicache) recordCycle() {
+	var total uint64
+	for _, s := range b.shards {
+		total += atomic.LoadUint64(&s.counters.mfuEvictions)
+		total += atomic.LoadUint64(&s.counters.mruEvictions)
+	}
+
+	now := time.Now().UnixNano()
+	prevTotal := atomic.SwapUint64(&b.cycleEvictions, total)
+	prevCycle := atomic.SwapInt64(&b.lastEvictCycle, now)
+
+	// There's no interval before
+	// the first completed cycle.
+	if prevCycle == 0 {
+		return
+	}
+
+	atomic.StoreUint64(&b.recentEvicted, total-prevTotal)
+	atomic.StoreInt64(&b.recentInterval, now-prevCycle)
+}
+
+// SyncEvict synchronously runs a full TTL
+// and promotion/eviction cycle across all shards,
+// returning once complete. This is independent of
+// the AutoEvict interval.
+func (b *Bicache) SyncEvict() {
+	b.evictCycle(0, nil, nil, false)
+}
+
+// LastEvictCycle returns the time that the last
+// background eviction cycle completed. A zero time
+// is returned if no cycle has completed. This can be
+// used to detect a stalled eviction task.
+func (b *Bicache) LastEvictCycle() time.Time {
+	ts := atomic.LoadInt64(&b.lastEvictCycle)
+	if ts == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ts)
+}
+
+// Pressure returns a signal in the range [0, 1]
+// indicating how pressured the cache is for capacity,
+// where higher values suggest that the cache should be
+// grown. It's the mean of the MRU used percent (the MFU
+// used percent if there's no MRU) and the number of
+// capacity evictions between the last two eviction
+// cycles relative to the cache size (capped at 1).
+// A full cache with no evictions has a pressure of 0.5.
+func (b *Bicache) Pressure() float64 {
+	stats := b.Stats()
+
+	used := float64(stats.MRUUsedP) / 100
+	if stats.MRUMaxSize == 0 {
+		used = float64(stats.MFUUsedP) / 100
+	}
+
+	var churn float64
+	if size := stats.MFUMaxSize + stats.MRUMaxSize; size > 0 {
+		churn = float64(atomic.LoadUint64(&b.recentEvicted)) / float64(size)
+	}
+
+	if churn > 1 {
+		churn = 1
+	}
+
+	return (used + churn) / 2
+}
+
+// TTLCount returns the number of
+// keys with a TTL across all shards.
+func (b *Bicache) TTLCount() uint64 {
+	var count uint64
+	for _, s := range b.shards {
+		count += atomic.LoadUint64(&s.ttlCount)
+	}
+
+	return count
+}
+
+// Validate checks the internal consistency of
+// each shard, returning an error describing the
+// first inconsistency found. Each shard is read
+// locked while it's checked. This walks every key
+// and is intended for tests and debugging.
+func (b *Bicache) Validate() error {
+	for _, s := range b.shards {
+		s.RLock()
+		err := s.validate()
+		s.RUnlock()
+
+		if err != nil {
+			return fmt.Errorf("shard %d: %s", s.index, err)
+		}
+	}
+
+	return nil
+}
+
 // Stats returns a *Stats with
 // Bicache statistics data.
 func (b *Bicache) Stats() *Stats {
-	stats := &Stats{}
+	stats := &Stats{
+		Paused: atomic.LoadUint32(&b.paused) == 1,
+		Time:   time.Now(),
+	}
 	var mfuCap, mruCap float64
 
 	for _, s := range b.shards {
 		s.RLock()
-		stats.MFUSize += s.mfuCache.Len()
+		stats.MFUSize += s.mfuLen()
 		stats.MRUSize += s.mruCache.Len()
-		s.RUnlock()
-
 		mfuCap += float64(s.mfuCap)
 		mruCap += float64(s.mruCap)
+		s.RUnlock()
 
 		stats.Hits += atomic.LoadUint64(&s.counters.hits)
 		stats.Misses += atomic.LoadUint64(&s.counters.misses)
+		stats.Sets += atomic.LoadUint64(&s.counters.sets)
 		stats.Evictions += atomic.LoadUint64(&s.counters.evictions)
+		stats.MFUEvictions += atomic.LoadUint64(&s.counters.mfuEvictions)
+		stats.MRUEvictions += atomic.LoadUint64(&s.counters.mruEvictions)
 		stats.Overflows += atomic.LoadUint64(&s.counters.overflows)
+		stats.TooLarge += atomic.LoadUint64(&s.counters.tooLarge)
+		stats.TooLong += atomic.LoadUint64(&s.counters.tooLong)
+		stats.Closed += atomic.LoadUint64(&s.counters.closed)
+		stats.DeferredOverflows += atomic.LoadUint64(&s.counters.deferredOverflows)
+		stats.TTLKeys += atomic.LoadUint64(&s.ttlCount)
+	}
+
+	stats.Rejections = stats.Overflows + stats.TooLarge + stats.TooLong + stats.Closed
+
+	if interval := atomic.LoadInt64(&b.recentInterval); interval > 0 {
+		evicted := float64(atomic.LoadUint64(&b.recentEvicted))
+		stats.EvictionRate = evicted / time.Duration(interval).Seconds()
+	}
+
+	stats.HookPanics = atomic.LoadUint64(&b.hooks.panics)
+
+	if b.lockWait != nil {
+		b.lockWaitLock.Lock()
+		lockWait := b.lockWait.Calc()
+		b.lockWaitLock.Unlock()
+
+		stats.LockWaitP50 = lockWait.Time.P50
+		stats.LockWaitP99 = lockWait.Time.P99
 	}
 
 	stats.MFUMaxSize = uint(mfuCap)
 	stats.MRUMaxSize = uint(mruCap)
 
-	stats.MRUUsedP = uint(float64(stats.MRUSize) / mruCap * 100)
+	// Prevent incorrect stats in MFU-only mode.
+	if mruCap > 0 {
+		stats.MRUUsedP = uint(float64(stats.MRUSize) / mruCap * 100)
+	}
+
 	// Prevent incorrect stats in MRU-only mode.
 	if mfuCap > 0 {
 		stats.MFUUsedP = uint(float64(stats.MFUSize) / mfuCap * 100)
@@ -288,12 +1424,147 @@ func (b *Bicache) Stats() *Stats {
 		stats.MFUUsedP = 0
 	}
 
+	// Caches can briefly run over capacity
+	// between eviction cycles. Cap used percent
+	// at 100; the sizes still reflect the
+	// actual key counts.
+	if stats.MRUUsedP > 100 {
+		stats.MRUUsedP = 100
+	}
+
+	if stats.MFUUsedP > 100 {
+		stats.MFUUsedP = 100
+	}
+
 	return stats
 }
 
-// evictTTL evicts expired keys using a mark
-// sweep garbage collection. The number of keys
-// evicted is returned.
+// StatsDelta returns the per second rates of hits,
+// misses, evictions and sets between prev, a Stats
+// previously returned by Stats, and now. This is
+// useful for reporting interval rates from periodic
+// Stats snapshots. All rates are 0 if no time has
+// elapsed since prev.
+func (b *Bicache) StatsDelta(prev *Stats) *StatsDelta {
+	return prev.delta(b.Stats())
+}
+
+// StatsDetailed returns a *DetailedStats with
+// the Stats data along with statistics that
+// require scanning every key in each shard
+// (e.g. ColdKeys, the count of keys with a score
+// of 0). Each shard is read locked while it's
+// scanned, making this considerably more expensive
+// than Stats. Score quantiles are computed from
+// up to 65536 scores sampled evenly across shards.
+func (b *Bicache) StatsDetailed() *DetailedStats {
+	stats := &DetailedStats{Stats: *b.Stats()}
+
+	perShard := scoreSamples / len(b.shards)
+	if perShard == 0 {
+		perShard = 1
+	}
+
+	var scores []uint64
+
+	for _, s := range b.shards {
+		s.RLock()
+		var cold uint64
+		cold, scores = s.scoreStats(scores, perShard)
+		s.RUnlock()
+
+		stats.ColdKeys += cold
+	}
+
+	if len(scores) > 0 {
+		sort.Slice(scores, func(i, j int) bool {
+			return scores[i] < scores[j]
+		})
+
+		stats.MedianScore = scores[len(scores)/2]
+		stats.P99Score = scores[len(scores)*99/100]
+	}
+
+	return stats
+}
+
+// WarmRatio returns the number of cached keys as a
+// fraction of the cache capacity, in the range [0, 1].
+// Caches briefly over capacity report 1.
+func (b *Bicache) WarmRatio() float64 {
+	var keys, capacity float64
+
+	for _, s := range b.shards {
+		s.RLock()
+		keys += float64(s.mfuLen() + s.mruCache.Len())
+		capacity += float64(s.mfuCap + s.mruCap)
+		s.RUnlock()
+	}
+
+	if capacity == 0 || keys >= capacity {
+		return 1
+	}
+
+	return keys / capacity
+}
+
+// IsWarm returns whether or not the WarmRatio is at
+// least threshold, e.g. for gating service readiness
+// on the cache being sufficiently populated after
+// a restart.
+func (b *Bicache) IsWarm(threshold float64) bool {
+	return b.WarmRatio() >= threshold
+}
+
+// scoreStats returns the number of keys with a
+// score of 0, along with the scores of up to n
+// keys appended to scores. The shard must be
+// locked.
+func (s *Shard) scoreStats(scores []uint64, n int) (uint64, []uint64) {
+	var cold uint64
+	for _, e := range s.cacheMap {
+		score := atomic.LoadUint64(&e.node.Score)
+		if score == 0 {
+			cold++
+		}
+
+		if n > 0 {
+			scores = append(scores, score)
+			n--
+		}
+	}
+
+	return cold, scores
+}
+
+// delta returns the per second
+// rates between s and next.
+func (s *Stats) delta(next *Stats) *StatsDelta {
+	d := &StatsDelta{Interval: next.Time.Sub(s.Time)}
+
+	secs := d.Interval.Seconds()
+	if secs <= 0 {
+		return d
+	}
+
+	rate := func(prev, cur uint64) float64 {
+		if cur < prev {
+			return 0
+		}
+		return float64(cur-prev) / secs
+	}
+
+	d.Hits = rate(s.Hits, next.Hits)
+	d.Misses = rate(s.Misses, next.Misses)
+	d.Evictions = rate(s.Evictions, next.Evictions)
+	d.Sets = rate(s.Sets, next.Sets)
+
+	return d
+}
+
+// evictTTL evicts expired keys using a mark
+// sweep garbage collection. The number of keys
+// evicted is returned.
 func (s *Shard) evictTTL() int {
 	// Return if we have no TTL'd keys.
 	if atomic.LoadUint64(&s.ttlCount) == 0 {
@@ -305,11 +1576,18 @@ func (s *Shard) evictTTL() int {
 	expired := list.New()
 
 	// Set initial nearest expire.
-	nearestExpire := time.Now().Add(time.Second * 2147483647)
+	nearestExpire := noExpire
 
-	s.RLock()
+	// Scan under the ttlLock only, so
+	// that the scan doesn't block sets
+	// (and gets queued behind them).
+	s.ttlLock.Lock()
 
-	now := time.Now()
+	// Track expirations set
+	// during the scan/evict.
+	s.scanNearest = noExpire
+
+	now := s.clock.Now()
 	for k, ttl := range s.ttlMap {
 		if now.After(ttl) {
 			// Add to expired.
@@ -317,42 +1595,40 @@ func (s *Shard) evictTTL() int {
 		} else {
 			// If the key isn't expiring, it is
 			// eligible for the nearest expire value.
-			if ttl.Before(nearestExpire) {
-				nearestExpire = ttl
-			}
+			nearestExpire = earliest(nearestExpire, ttl)
 		}
 	}
 
-	s.RUnlock()
+	s.ttlLock.Unlock()
 
 	// Lock and evict.
 	s.Lock()
 
 	var evicted int
-	for k := expired.Front(); k != nil; k = k.Next() {
-		if n, exists := s.cacheMap[k.Value.(string)]; exists {
-			delete(s.cacheMap, k.Value.(string))
-			delete(s.ttlMap, k.Value.(string))
-			switch n.state {
-			case 0:
-				s.mruCache.Remove(n.node)
-			case 1:
-				s.mfuCache.Remove(n.node)
-			}
+	for e := expired.Front(); e != nil; e = e.Next() {
+		k := e.Value.(string)
+		// Skip keys that had their
+		// TTL reset since the scan.
+		if ttl, hasTTL := s.ttlMap[k]; !hasTTL || !now.After(ttl) {
+			continue
+		}
+
+		if n, exists := s.cacheMap[k]; exists {
+			s.evict(k, n, EvictReasonTTL)
 			evicted++
 		}
 	}
 
 	// Update the nearest expire.
 	// If the last TTL'd key was just expired,
-	// this will be left at the initially set value
-	// at the top of evictTTL. This means that the
-	// auto eviction runs will just skip
+	// this will be left at noExpire. This means
+	// that the auto eviction runs will just skip
 	// evictTTL until a SetTTL creates a real
-	// nearest expire timestamp (since it's checking
-	// if the nearest expire happens within the auto
-	// evict interval).
-	s.nearestExpire = nearestExpire
+	// nearest expire timestamp. Expirations set
+	// since the scan started are accounted for.
+	s.ttlLock.Lock()
+	s.nearestExpire = earliest(nearestExpire, s.scanNearest)
+	s.ttlLock.Unlock()
 
 	s.Unlock()
 
@@ -367,22 +1643,51 @@ func (s *Shard) evictTTL() int {
 // MRU scores are checked against the MFU. If any of the top MRU scores
 // are greater than the lowest MFU scores, they are promoted
 // to the MFU (if possible). Any remaining overflow count
-// is evicted from the tail of the MRU.
-func (s *Shard) promoteEvict() {
-	// How far over MRU capacity are we?
-	mruOverflow := int(s.mruCache.Len() - s.mruCap)
+// is evicted from the tail of the MRU. Returns whether
+// or not any promotions or evictions occurred.
+func (s *Shard) promoteEvict() bool {
+	// LRU and FIFO modes have no MFU;
+	// simply evict from the MRU tail.
+	if s.mode.mruOnly() {
+		s.Lock()
+		active := s.mruOverflow() > 0
+		s.evictLRUOverflow()
+		s.Unlock()
+
+		return active
+	}
+
+	// Read the capacities, which Reconfigure
+	// changes, and how far over the MRU low
+	// watermark we are under the lock.
+	s.RLock()
+	mfuCap, mruCap := s.mfuCap, s.mruCap
+	mruOverflow := s.mruOverflow()
+	s.RUnlock()
+
+	// If MRU cap is 0, this is an MFU-only
+	// cache. Evict the lowest scores.
+	if mruCap == 0 {
+		s.Lock()
+		active := s.overCapacity() > 0
+		s.evictMFULowScores()
+		s.Unlock()
+
+		return active
+	}
+
 	if mruOverflow <= 0 {
-		return
+		return false
 	}
 
 	// If MFU cap is 0, shortcut to
 	// LRU-only behavior.
-	if s.mfuCap == 0 {
+	if mfuCap == 0 {
 		s.Lock()
 		s.evictFromMRUTail(mruOverflow)
 		s.Unlock()
 
-		return
+		return true
 	}
 
 	// Get the top n MRU elements
@@ -433,12 +1738,15 @@ func (s *Shard) promoteEvict() {
 			if node.Score < 2 {
 				break
 			}
+			// Skip nodes removed before
+			// the lock was acquired.
+			if !s.linked(node, 0) {
+				continue
+			}
 			// Remove from the MRU and
 			// push to the MFU tail.
 			// Update cache state.
-			s.mruCache.Remove(node)
-			s.mfuCache.PushTailNode(node)
-			s.cacheMap[node.Value.(*cacheData).k].state = 1
+			s.promote(node)
 
 			promoted++
 		}
@@ -447,7 +1755,7 @@ func (s *Shard) promoteEvict() {
 		// all the overflow, return.
 		if promoted == mruOverflow {
 			s.Unlock()
-			return
+			return true
 		}
 	}
 
@@ -475,7 +1783,7 @@ promoteByScore:
 
 	// If the lowest MFU score is higher than the lowest
 	// score to promote, none of these are eligible.
-	if len(bottomMFU) == 0 || bottomMFU[0].Score >= mruToPromoteEvict[remainderPosition].Score {
+	if len(bottomMFU) == 0 || !s.outscores(mruToPromoteEvict[remainderPosition], bottomMFU[0]) {
 		goto evictFromMRUTail
 	}
 
@@ -483,19 +1791,24 @@ promoteByScore:
 	s.Lock()
 scorePromote:
 	for _, mruNode := range mruToPromoteEvict[remainderPosition:] {
+		if !s.linked(mruNode, 0) {
+			continue
+		}
+
 		for i, mfuNode := range bottomMFU {
-			if mruNode.Score > mfuNode.Score {
+			if s.outscores(mruNode, mfuNode) && s.linked(mfuNode, 1) {
 				// Push the evicted MFU node to the head
-				// of the MRU and update state.
-				s.mfuCache.Remove(mfuNode)
-				s.mruCache.PushHeadNode(mfuNode)
-				s.cacheMap[mfuNode.Value.(*cacheData).k].state = 0
+				// of the MRU and update state, or evict
+				// it outright if configured.
+				if s.evictDisplaced {
+					s.evictKeys([]string{mfuNode.Value.(*cacheData).k}, EvictReasonCapacity)
+				} else {
+					s.demote(mfuNode)
+				}
 
 				// Promote the MRU node to the MFU and
 				// update state.
-				s.mruCache.Remove(mruNode)
-				s.mfuCache.PushTailNode(mruNode)
-				s.cacheMap[mruNode.Value.(*cacheData).k].state = 1
+				s.promote(mruNode)
 
 				promotedByScore++
 
@@ -519,24 +1832,47 @@ evictFromMRUTail:
 
 	// What's the overflow remainder count?
 	toEvict := mruOverflow - promotedByScore
+
+	// If configured, make room in the MRU by
+	// evicting the lowest score MFU keys and
+	// promoting the remaining MRU candidates.
+	if s.evictMFUFirst && toEvict > 0 {
+		toEvict -= s.evictMFUForMRU(toEvict, mruToPromoteEvict[remainderPosition:])
+	}
+
 	// Evict this many from the MRU tail.
 	if toEvict > 0 {
 		s.evictFromMRUTail(toEvict)
 	}
 
 	s.Unlock()
+
+	return true
 }
 
-// evictFromMRUTail evicts n keys from the tail
-// of the MRU cache.
-func (s *Shard) evictFromMRUTail(n int) {
+// evictFromMRUTail evicts up to n keys from the
+// tail of the MRU cache. The number of keys evicted
+// is returned, which is less than n if the MRU has
+// fewer keys or CanEvict vetoes evictions.
+func (s *Shard) evictFromMRUTail(n int) int {
 	ttlStart := len(s.ttlMap)
 
-	for i := 0; i < n; i++ {
-		node := s.mruCache.Tail()
-		delete(s.cacheMap, node.Value.(*cacheData).k)
-		delete(s.ttlMap, node.Value.(*cacheData).k)
-		s.mruCache.RemoveTail()
+	var evicted int
+
+	switch {
+	case s.canEvict != nil:
+		evicted = s.evictFromMRUVetoable(n)
+	case s.prioritized == 0:
+		for ; evicted < n && s.mruCache.Len() > 0; evicted++ {
+			k := s.mruCache.Tail().Value.(*cacheData).k
+			s.evict(k, s.cacheMap[k], EvictReasonCapacity)
+		}
+	default:
+		for _, node := range s.mruVictims(n) {
+			k := node.Value.(*cacheData).k
+			s.evict(k, s.cacheMap[k], EvictReasonCapacity)
+			evicted++
+		}
 	}
 
 	// Update the ttlCount.
@@ -545,9 +1881,1078 @@ func (s *Shard) evictFromMRUTail(n int) {
 	// Update eviction count.
 	// Excludes TTL evictions since the
 	// decrementTTLCount handles that for us.
+	atomic.AddUint64(&s.counters.evictions, uint64(evicted-ttlEvicted))
+
+	return evicted
+}
+
+// evictFromMRUVetoable evicts up to n keys from the
+// MRU in the same order as evictFromMRUTail, skipping
+// keys that CanEvict vetoes in favor of the next
+// coldest. At most maxEvictVetoes keys are skipped,
+// bounding the cost of a pass where most keys are
+// vetoed. The number of keys evicted is returned.
+// The shard must be locked.
+func (s *Shard) evictFromMRUVetoable(n int) int {
+	var evicted, vetoed int
+
+	// try evicts the node unless vetoed and returns
+	// whether or not to continue evicting.
+	try := func(node *sll.Node) bool {
+		k := node.Value.(*cacheData).k
+		e := s.cacheMap[k]
+
+		// A panicking CanEvict doesn't
+		// veto the eviction.
+		evict := true
+		s.hooks.callLocked("CanEvict", func() { evict = s.canEvict(k, e.value()) })
+
+		if evict {
+			s.evict(k, e, EvictReasonCapacity)
+			evicted++
+		} else {
+			vetoed++
+		}
+
+		return evicted < n && vetoed < maxEvictVetoes
+	}
+
+	if s.prioritized == 0 {
+		for node := s.mruCache.Tail(); node != nil; {
+			// The node is released
+			// for reuse if evicted.
+			next := node.Next()
+			if !try(node) {
+				break
+			}
+			node = next
+		}
+	} else {
+		// At most n keys are evicted and
+		// maxEvictVetoes keys vetoed.
+		for _, node := range s.mruVictims(n + maxEvictVetoes) {
+			if !try(node) {
+				break
+			}
+		}
+	}
+
+	// Only log skipped evictions caused by vetoes,
+	// rather than by the MRU having fewer than n keys.
+	if evicted < n && vetoed > 0 {
+		log.Printf("[Bicache] CanEvict vetoed %d keys in shard %d, %d evictions skipped\n", vetoed, s.index, n-evicted)
+	}
+
+	return evicted
+}
+
+// evictLRUOverflow evicts keys in excess of the
+// MRU capacity (down to the low watermark) from
+// the MRU tail. The shard must be locked.
+func (s *Shard) evictLRUOverflow() {
+	if over := s.mruOverflow(); over > 0 {
+		s.evictFromMRUTail(over)
+	}
+}
+
+// evictMFUForMRU evicts up to n of the lowest score
+// MFU keys, promoting MRU nodes from candidates into
+// the freed MFU slots. Candidates that are no longer
+// in the MRU are skipped. The number of nodes promoted
+// is returned. The shard must be locked.
+func (s *Shard) evictMFUForMRU(n int, candidates sll.NodeScoreList) int {
+	victims := s.lowScores(s.mfuCache, n)
+
+	var promote []*sll.Node
+	for _, node := range candidates {
+		if len(promote) == len(victims) {
+			break
+		}
+
+		if !s.linked(node, 0) {
+			continue
+		}
+
+		promote = append(promote, node)
+	}
+
+	keys := make([]string, len(promote))
+	for i := range promote {
+		keys[i] = victims[i].Value.(*cacheData).k
+	}
+
+	s.evictKeys(keys, EvictReasonCapacity)
+
+	for _, node := range promote {
+		s.promote(node)
+	}
+
+	return len(promote)
+}
+
+// victim is a node considered for eviction
+// by victims, with the keys it's ordered by.
+type victim struct {
+	node     *sll.Node
+	priority int
+	score    uint64
+	pos      int // Position from the list tail.
+}
+
+// before returns whether v is evicted before u:
+// lower priorities first, then lower scores, then
+// nodes nearer the list tail.
+func (v victim) before(u victim) bool {
+	if v.priority != u.priority {
+		return v.priority < u.priority
+	}
+
+	if v.score != u.score {
+		return v.score < u.score
+	}
+
+	return v.pos < u.pos
+}
+
+// victimHeap is a max heap of victims, with
+// the victim evicted last at the root.
+type victimHeap []victim
+
+func (h victimHeap) Len() int           { return len(h) }
+func (h victimHeap) Less(i, j int) bool { return h[j].before(h[i]) }
+func (h victimHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *victimHeap) Push(x interface{}) {
+	*h = append(*h, x.(victim))
+}
+
+func (h *victimHeap) Pop() interface{} {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return v
+}
+
+// victims returns the n nodes of ll to evict first,
+// in eviction order: lower priority nodes first, with
+// ties broken by score if scored is set and then by
+// position from the tail. Like sll.LowScores, the
+// nodes are selected with a bounded heap. The shard
+// must be locked.
+func (s *Shard) victims(ll *sll.Sll, n int, scored bool) []*sll.Node {
+	if n <= 0 || ll.Len() == 0 {
+		return nil
+	}
+
+	if n > int(ll.Len()) {
+		n = int(ll.Len())
+	}
+
+	h := make(victimHeap, 0, n)
+
+	var pos int
+	for node := ll.Tail(); node != nil; node = node.Next() {
+		v := victim{
+			node:     node,
+			priority: node.Value.(*cacheData).priority,
+			pos:      pos,
+		}
+		pos++
+
+		if scored {
+			v.score = atomic.LoadUint64(&node.Score)
+		}
+
+		switch {
+		case len(h) < n:
+			h = append(h, v)
+			if len(h) == n {
+				heap.Init(&h)
+			}
+		case v.before(h[0]):
+			h[0] = v
+			heap.Fix(&h, 0)
+		}
+	}
+
+	sort.Slice(h, func(i, j int) bool { return h[i].before(h[j]) })
+
+	nodes := make([]*sll.Node, len(h))
+	for i := range h {
+		nodes[i] = h[i].node
+	}
+
+	return nodes
+}
+
+// mruVictims returns the n MRU nodes to evict,
+// preferring lower priority nodes and breaking
+// ties by recency (starting from the MRU tail).
+// The shard must be locked.
+func (s *Shard) mruVictims(n int) []*sll.Node {
+	return s.victims(s.mruCache, n, false)
+}
+
+// lowScores returns the n nodes of ll with the
+// lowest scores in ascending order. If any keys in
+// the shard have a priority, lower priority nodes
+// are preferred, breaking ties by score. The shard
+// must be locked.
+func (s *Shard) lowScores(ll *sll.Sll, n int) sll.NodeScoreList {
+	if s.prioritized == 0 {
+		return ll.LowScores(n)
+	}
+
+	return s.victims(ll, n, true)
+}
+
+// nodes returns all nodes of ll, starting
+// from the tail. The shard must be locked.
+func (s *Shard) nodes(ll *sll.Sll) []*sll.Node {
+	if ll.Len() == 0 {
+		return nil
+	}
+
+	nodes := make([]*sll.Node, 0, ll.Len())
+	for node := ll.Tail(); node != nil; node = node.Next() {
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// copyInto copies the shard's entries, lists,
+// scores and TTLs into ns, which must be empty.
+// Values and metadata are copied by reference.
+// The shard must be read locked and ns locked.
+func (s *Shard) copyInto(ns *Shard) {
+	// copyList copies ll, replacing the copied
+	// nodes' cacheData and adding entries
+	// for them to the ns cache map.
+	copyList := func(ll *sll.Sll) *sll.Sll {
+		cp := ll.Copy()
+		if cp.Len() == 0 {
+			return cp
+		}
+
+		for node, n := ll.Head(), cp.Head(); node != nil; node, n = node.Prev(), n.Prev() {
+			cd := node.Value.(*cacheData)
+			n.Value = &cacheData{k: cd.k, v: cd.v, priority: cd.priority}
+
+			e := *s.cacheMap[cd.k]
+			e.node = n
+			ns.cacheMap[cd.k] = &e
+		}
+
+		return cp
+	}
+
+	ns.mruCache = copyList(s.mruCache)
+	if s.mfuCache != nil {
+		ns.mfuCache = copyList(s.mfuCache)
+	}
+
+	ns.prioritized = s.prioritized
+
+	ns.ttlLock.Lock()
+	for k, t := range s.ttlMap {
+		ns.ttlMap[k] = t
+	}
+	ns.nearestExpire = s.nearestExpire
+	ns.scanNearest = s.scanNearest
+	ns.ttlLock.Unlock()
+
+	ns.syncTTLCount()
+}
+
+// reclaim reclaims the values of up to n keys,
+// starting from the MRU tail followed by the
+// lowest score MFU keys. The keys and their
+// metadata are retained. The number of values
+// reclaimed is returned. The shard must be locked.
+func (s *Shard) reclaim(n int) int {
+	candidates := s.nodes(s.mruCache)
+	if s.mfuCache != nil && s.mfuCache.Len() > 0 {
+		candidates = append(candidates, s.mfuCache.LowScores(int(s.mfuCache.Len()))...)
+	}
+
+	var reclaimed int
+	for _, node := range candidates {
+		if reclaimed == n {
+			break
+		}
+
+		cd := node.Value.(*cacheData)
+		if _, ok := cd.v.(reclaimedValue); ok {
+			continue
+		}
+
+		cd.v = reclaimedValue{}
+		reclaimed++
+	}
+
+	return reclaimed
+}
+
+// promoteWorkingSet promotes the highest score MRU
+// keys into the free MFU slots, regardless of score.
+// The number of keys promoted is returned. The shard
+// must be locked.
+func (s *Shard) promoteWorkingSet() int {
+	if s.mfuCap == 0 || s.mruCap == 0 {
+		return 0
+	}
+
+	mfuFree := int(s.mfuCap) - int(s.mfuCache.Len())
+	if mfuFree <= 0 {
+		return 0
+	}
+
+	// Promote in descending score order.
+	candidates := s.mruCache.HighScores(mfuFree)
+	sort.Sort(sort.Reverse(candidates))
+
+	for _, node := range candidates {
+		s.promote(node)
+	}
+
+	return len(candidates)
+}
+
+// restore sets the value of the existing
+// entry e to v, moving MRU entries to the
+// MRU head. The shard must be locked.
+func (s *Shard) restore(e *entry, v interface{}) {
+	e.node.Value.(*cacheData).v = v
+	s.touch(e)
+}
+
+// touch moves an MRU entry e to the MRU
+// head after a write, except in ModeFIFO
+// where keys remain in insertion order.
+// The shard must be locked.
+func (s *Shard) touch(e *entry) {
+	if e.state == 0 && s.mode != ModeFIFO {
+		s.mruCache.MoveToHead(e.node)
+	}
+}
+
+// setPriority sets the priority of entry
+// e to p. The shard must be locked.
+func (s *Shard) setPriority(e *entry, p int) {
+	cd := e.node.Value.(*cacheData)
+
+	switch {
+	case cd.priority == 0 && p != 0:
+		s.prioritized++
+	case cd.priority != 0 && p == 0:
+		s.prioritized--
+	}
+
+	cd.priority = p
+}
+
+// priority returns the priority of the
+// key stored in node. The shard must be
+// locked.
+func (s *Shard) priority(node *sll.Node) int {
+	return node.Value.(*cacheData).priority
+}
+
+// highScores returns the top n keys by score
+// from each of the shard's cache tiers. n must
+// be > 0. The shard must be read locked.
+func (s *Shard) highScores(n int) []KeyInfo {
+	var keys []KeyInfo
+
+	for state, ll := range []*sll.Sll{s.mruCache, s.mfuCache} {
+		if ll == nil {
+			continue
+		}
+
+		for _, node := range ll.HighScores(n) {
+			keys = append(keys, KeyInfo{
+				Key:      node.Value.(*cacheData).k,
+				State:    uint8(state),
+				Score:    atomic.LoadUint64(&node.Score),
+				Priority: s.priority(node),
+			})
+		}
+	}
+
+	return keys
+}
+
+// evictFromMFUHead evicts n keys from the head
+// of the MFU cache, which holds the least
+// recently promoted keys.
+func (s *Shard) evictFromMFUHead(n int) {
+	ttlStart := len(s.ttlMap)
+
+	for i := 0; i < n; i++ {
+		k := s.mfuCache.Head().Value.(*cacheData).k
+		s.evict(k, s.cacheMap[k], EvictReasonCapacity)
+	}
+
+	ttlEvicted := ttlStart - len(s.ttlMap)
+	s.decrementTTLCount(uint64(ttlEvicted))
 	atomic.AddUint64(&s.counters.evictions, uint64(n-ttlEvicted))
 }
 
+// evictKeys evicts each of keys that
+// still exist in the shard for the given reason.
+// The number of keys evicted is returned. The
+// shard must be locked.
+func (s *Shard) evictKeys(keys []string, reason string) int {
+	ttlStart := len(s.ttlMap)
+
+	var evicted int
+	for _, k := range keys {
+		if e, exists := s.cacheMap[k]; exists {
+			s.evict(k, e, reason)
+			evicted++
+		}
+	}
+
+	ttlEvicted := ttlStart - len(s.ttlMap)
+	s.decrementTTLCount(uint64(ttlEvicted))
+	atomic.AddUint64(&s.counters.evictions, uint64(evicted-ttlEvicted))
+
+	return evicted
+}
+
+// remove removes key k and its entry e
+// from the shard. The shard must be locked.
+func (s *Shard) remove(k string, e *entry) {
+	delete(s.cacheMap, k)
+	s.deleteExpiration(k)
+
+	if e.priority() != 0 {
+		s.prioritized--
+	}
+
+	switch e.state {
+	case 0:
+		s.mruCache.Remove(e.node)
+	case 1:
+		s.mfuCache.Remove(e.node)
+	}
+
+	s.signalSpace()
+
+	s.release(e)
+}
+
+// evict removes key k and its entry e
+// from the shard, records the eviction for the
+// given reason in the eviction history and calls
+// the OnEvict hook, if configured. The shard must
+// be locked.
+func (s *Shard) evict(k string, e *entry, reason string) {
+	// The entry is released
+	// for reuse by remove.
+	state, v := e.state, e.value()
+	s.remove(k, e)
+
+	if reason == EvictReasonCapacity {
+		switch state {
+		case 0:
+			atomic.AddUint64(&s.counters.mruEvictions, 1)
+		case 1:
+			atomic.AddUint64(&s.counters.mfuEvictions, 1)
+		}
+	}
+
+	if s.history != nil {
+		s.history.add(EvictionRecord{Key: k, Reason: reason, Time: time.Now()})
+	}
+
+	if s.onEvict != nil {
+		s.hooks.callLocked("OnEvict", func() { s.onEvict(k, v) })
+	}
+
+	if s.onEvictBatch != nil {
+		s.evicted = append(s.evicted, EvictedEntry{Key: k, Value: v, Reason: reason})
+	}
+}
+
+// expiration returns the expiration time
+// for a TTL of t seconds, including any
+// configured jitter.
+func (s *Shard) expiration(t int32) time.Time {
+	return s.expireAfter(time.Second * time.Duration(t))
+}
+
+// expireAfter returns the expiration time
+// for a TTL of d, including any configured
+// jitter.
+func (s *Shard) expireAfter(d time.Duration) time.Time {
+	expiration := s.clock.Now().Add(d)
+
+	if s.ttlJitter > 0 {
+		expiration = expiration.Add(time.Duration(s.int63n(int64(s.ttlJitter))))
+	}
+
+	return expiration
+}
+
+// randomKey returns a random key from the
+// shard and true, or false if the shard has
+// no keys with values. Keys are selected by
+// iterating the cache map to a random offset.
+// The shard must be locked.
+func (s *Shard) randomKey() (string, bool) {
+	if len(s.cacheMap) == 0 {
+		return "", false
+	}
+
+	offset := int(s.int63n(int64(len(s.cacheMap))))
+
+	// Reclaimed keys are skipped, returning
+	// the first key with a value at or
+	// after the offset.
+	var i int
+	for k, e := range s.cacheMap {
+		if i >= offset && !e.reclaimed() {
+			return k, true
+		}
+		i++
+	}
+
+	return "", false
+}
+
+// int63n returns a random number in the
+// range [0, n) from the shard's random source.
+func (s *Shard) int63n(n int64) int64 {
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+
+	return s.rng.Int63n(n)
+}
+
+// evictMFULowScores evicts the lowest score
+// keys from the MFU cache in excess of the
+// MFU capacity. This is only used for MFU-only
+// caches, where keys are set directly
+// into the MFU.
+func (s *Shard) evictMFULowScores() {
+	s.evictMFULowest(int(s.mfuCache.Len()) - int(s.mfuCap))
+}
+
+// evictMFULowest evicts up to n of the lowest
+// score keys from the MFU cache. The number of
+// keys evicted is returned, which is at most the
+// MFU length. The shard must be locked.
+func (s *Shard) evictMFULowest(n int) int {
+	if l := int(s.mfuLen()); n > l {
+		n = l
+	}
+
+	if n <= 0 {
+		return 0
+	}
+
+	ttlStart := len(s.ttlMap)
+
+	victims := s.lowScores(s.mfuCache, n)
+	for _, node := range victims {
+		k := node.Value.(*cacheData).k
+		s.evict(k, s.cacheMap[k], EvictReasonCapacity)
+	}
+
+	// Update the ttlCount.
+	ttlEvicted := ttlStart - len(s.ttlMap)
+	s.decrementTTLCount(uint64(ttlEvicted))
+	atomic.AddUint64(&s.counters.evictions, uint64(len(victims)-ttlEvicted))
+
+	return len(victims)
+}
+
+// shardSize returns size divided
+// across shards, rounded up.
+func shardSize(size uint, shards int) int {
+	return int((uint64(size) + uint64(shards) - 1) / uint64(shards))
+}
+
+// newMFU returns a new MFU list for a shard
+// with an MFU capacity of cap. Shards without
+// an MFU (cap 0) don't allocate an MFU list.
+func newMFU(cap uint) *sll.Sll {
+	if cap == 0 {
+		return nil
+	}
+
+	return sll.New()
+}
+
+// mfuLen returns the number of
+// keys in the shard's MFU.
+func (s *Shard) mfuLen() uint {
+	if s.mfuCache == nil {
+		return 0
+	}
+
+	return s.mfuCache.Len()
+}
+
+// promote moves an MRU node to the
+// tail of the MFU and updates the entry
+// state. The shard must be locked.
+func (s *Shard) promote(node *sll.Node) {
+	s.mruCache.Remove(node)
+	s.mfuCache.PushTailNode(node)
+	s.cacheMap[node.Value.(*cacheData).k].state = 1
+	s.signalSpace()
+}
+
+// checkEntry logs an inconsistency between the
+// state of key k's entry n and the list its node
+// is linked in. The shard must be locked.
+func (b *Bicache) checkEntry(s *Shard, k string, n *entry) {
+	if err := s.checkEntry(k, n); err != nil {
+		log.Printf("[Bicache] Inconsistent entry in shard %d: %s\n", s.index, err)
+	}
+}
+
+// checkEntry returns an error if the node of key
+// k's entry e isn't linked in the list of the tier
+// implied by the entry state. The shard must be
+// locked.
+func (s *Shard) checkEntry(k string, e *entry) error {
+	ll := s.mruCache
+	if e.state == 1 {
+		ll = s.mfuCache
+	}
+
+	if ll == nil || !ll.Has(e.node) {
+		return fmt.Errorf("key %s in state %d isn't linked in its tier", k, e.state)
+	}
+
+	return nil
+}
+
+// validate checks that every cache map entry's
+// node is linked in the list matching its state,
+// that the list lengths match the cache map and
+// that the prioritized and TTL counts match the
+// entries. The shard must be locked.
+func (s *Shard) validate() error {
+	// Map every linked node to
+	// the state of its list.
+	linked := make(map[*sll.Node]uint8, len(s.cacheMap))
+
+	for state, ll := range []*sll.Sll{s.mruCache, s.mfuCache} {
+		if ll == nil || ll.Len() == 0 {
+			continue
+		}
+
+		n := ll.Head()
+		for i := uint(0); i < ll.Len(); i++ {
+			if n == nil {
+				return fmt.Errorf("list in state %d has %d linked nodes, expected %d", state, i, ll.Len())
+			}
+
+			linked[n] = uint8(state)
+			n = n.Prev()
+		}
+
+		if n != nil {
+			return fmt.Errorf("list in state %d has more linked nodes than its length %d", state, ll.Len())
+		}
+	}
+
+	var prioritized int
+
+	for k, e := range s.cacheMap {
+		if e.priority() != 0 {
+			prioritized++
+		}
+
+		state, ok := linked[e.node]
+		switch {
+		case !ok:
+			return fmt.Errorf("key %q isn't linked in a list", k)
+		case state != e.state:
+			return fmt.Errorf("key %q has state %d but is linked in the state %d list", k, e.state, state)
+		case e.node.Value.(*cacheData).k != k:
+			return fmt.Errorf("key %q references the node for key %q", k, e.node.Value.(*cacheData).k)
+		}
+	}
+
+	if n := s.mfuLen() + s.mruCache.Len(); n != uint(len(s.cacheMap)) {
+		return fmt.Errorf("MFU and MRU lengths total %d, cache map has %d keys", n, len(s.cacheMap))
+	}
+
+	if prioritized != s.prioritized {
+		return fmt.Errorf("prioritized count is %d, %d keys have a priority", s.prioritized, prioritized)
+	}
+
+	if n := atomic.LoadUint64(&s.ttlCount); n != uint64(len(s.ttlMap)) {
+		return fmt.Errorf("TTL count is %d, TTL map has %d keys", n, len(s.ttlMap))
+	}
+
+	for k := range s.ttlMap {
+		if _, exists := s.cacheMap[k]; !exists {
+			return fmt.Errorf("TTL'd key %q isn't in the cache map", k)
+		}
+	}
+
+	return nil
+}
+
+// outscores returns whether or not MRU node
+// mru has a high enough score to displace MFU
+// node mfu.
+func (s *Shard) outscores(mru, mfu *sll.Node) bool {
+	if s.promoteOnTie {
+		return mru.Score >= mfu.Score
+	}
+
+	return mru.Score > mfu.Score
+}
+
+// demote moves an MFU node to the
+// head of the MRU and updates the entry
+// state. The shard must be locked.
+func (s *Shard) demote(node *sll.Node) {
+	s.mfuCache.Remove(node)
+	s.mruCache.PushHeadNode(node)
+	s.cacheMap[node.Value.(*cacheData).k].state = 0
+}
+
+// demoteMFUOverflow demotes the lowest score
+// MFU keys in excess of the MFU capacity to the
+// head of the MRU. The shard must be locked.
+func (s *Shard) demoteMFUOverflow() {
+	over := int(s.mfuLen()) - int(s.mfuCap)
+	if over <= 0 {
+		return
+	}
+
+	for _, node := range s.lowScores(s.mfuCache, over) {
+		s.demote(node)
+	}
+}
+
+// promoteMRU moves every MRU key to the MFU,
+// for shards whose MRU has been disabled. The
+// shard must be locked.
+func (s *Shard) promoteMRU() {
+	for node := s.mruCache.Tail(); node != nil; {
+		next := node.Next()
+		s.promote(node)
+		node = next
+	}
+}
+
+// signalSpace wakes any sets waiting for space
+// in SetBlocking. The shard must be locked.
+func (s *Shard) signalSpace() {
+	if atomic.LoadUint32(&s.waiting) == 0 {
+		return
+	}
+
+	close(s.space)
+	s.space = make(chan struct{})
+}
+
+// makeRoom evicts keys from a full shard so that
+// there's a free slot for each set waiting in
+// SetBlocking, waking them. Evictions otherwise
+// only bring a shard down to capacity, leaving
+// nothing for waiting sets.
+func (s *Shard) makeRoom() {
+	if atomic.LoadUint32(&s.waiting) == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	n := s.overCapacity() + int(atomic.LoadUint32(&s.waiting))
+	if n <= 0 {
+		return
+	}
+
+	if s.mruCap == 0 {
+		s.evictMFULowest(n)
+		return
+	}
+
+	if l := int(s.mruCache.Len()); n > l {
+		n = l
+	}
+
+	s.evictFromMRUTail(n)
+}
+
+// overCapacity returns the number of keys that the
+// tier new keys are set into is over capacity.
+func (s *Shard) overCapacity() int {
+	if s.mruCap == 0 {
+		return int(s.mfuCache.Len()) - int(s.mfuCap)
+	}
+
+	return int(s.mruCache.Len()) - int(s.mruCap)
+}
+
+// mruOverflow returns the number of MRU keys to
+// promote or evict if the MRU is over capacity
+// (including the overflow grace): the count of
+// keys over the low watermark.
+func (s *Shard) mruOverflow() int {
+	n := int(s.mruCache.Len())
+	if n <= int(float64(s.mruCap)*s.overflowGrace) {
+		return 0
+	}
+
+	return n - int(float64(s.mruCap)*s.lowWatermark)
+}
+
+// rejectsOverflow returns whether or not
+// sets of new keys into a full shard
+// are rejected (NoOverflow).
+func (s *Shard) rejectsOverflow() bool {
+	return atomic.LoadUint32(&s.noOverflow) == 1
+}
+
+// setNoOverflow sets whether or not sets
+// of new keys into a full shard are rejected.
+func (s *Shard) setNoOverflow(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+
+	atomic.StoreUint32(&s.noOverflow, v)
+}
+
+// free returns the number of keys that can be
+// inserted before the shard is full. This is
+// negative if the shard is over capacity.
+func (s *Shard) free() int {
+	if s.mruCap == 0 {
+		return int(s.mfuCap) - int(s.mfuCache.Len())
+	}
+
+	return int(s.mruCap) - int(s.mruCache.Len())
+}
+
+// full returns whether or not the tier
+// that new keys are set into is at capacity.
+func (s *Shard) full() bool {
+	if s.mruCap == 0 {
+		return s.mfuCache.Len() >= s.mfuCap
+	}
+
+	return s.mruCache.Len() >= s.mruCap
+}
+
+// insert creates an entry for k at the head
+// of the MRU cache, or the MFU cache if this is
+// an MFU-only cache. If OverflowEvict is set and
+// the shard is full, a key is evicted to make room
+// first. Otherwise, inserts into a full shard that
+// the background task evicts from are counted as
+// deferred overflows. The shard must be locked.
+func (s *Shard) insert(k string, v interface{}) *entry {
+	switch {
+	case s.overflowEvict && s.full():
+		if s.mruCap == 0 {
+			for _, node := range s.lowScores(s.mfuCache, 1) {
+				s.evictKeys([]string{node.Value.(*cacheData).k}, EvictReasonCapacity)
+			}
+		} else {
+			s.evictFromMRUTail(1)
+		}
+	case s.autoEvict && !s.mode.mruOnly() && s.full():
+		// The overflow is left for
+		// the background task.
+		atomic.AddUint64(&s.counters.deferredOverflows, 1)
+	}
+
+	e := s.newEntry(k, v)
+
+	if s.mruCap == 0 {
+		s.mfuCache.PushHeadNode(e.node)
+		e.state = 1
+	} else {
+		s.mruCache.PushHeadNode(e.node)
+	}
+
+	s.cacheMap[k] = e
+
+	return e
+}
+
+// newEntry returns an entry for key k and
+// value v with an unlinked node, reusing a
+// released entry if one is available.
+func (s *Shard) newEntry(k string, v interface{}) *entry {
+	e, ok := s.entries.Get().(*entry)
+	if !ok {
+		e = &entry{node: &sll.Node{Value: &cacheData{}}}
+	}
+
+	cd := e.node.Value.(*cacheData)
+	cd.k, cd.v = k, v
+
+	return e
+}
+
+// release resets entry e, which must already be
+// removed from the shard, and returns it to the
+// entry pool. Values and keys are cleared so that
+// pooled entries don't retain them.
+func (s *Shard) release(e *entry) {
+	cd := e.node.Value.(*cacheData)
+	cd.k, cd.v, cd.priority = "", nil, 0
+
+	atomic.StoreUint64(&e.node.Score, 0)
+	*e = entry{node: e.node}
+
+	s.entries.Put(e)
+}
+
+// linked returns whether node is still the node
+// of a cached key in the given state. Nodes gathered
+// before the shard was locked may have since been
+// removed, and reused through the entry pool. The
+// shard must be locked.
+func (s *Shard) linked(node *sll.Node, state uint8) bool {
+	e, exists := s.cacheMap[node.Value.(*cacheData).k]
+	return exists && e.node == node && e.state == state
+}
+
+// setExpiration sets the TTL expiration for
+// key k, updating the ttlCount and nearest expire.
+// The previous expiration and whether or not k
+// had a TTL are returned. The shard must be
+// write locked.
+func (s *Shard) setExpiration(k string, expiration time.Time) (time.Time, bool) {
+	s.ttlLock.Lock()
+	defer s.ttlLock.Unlock()
+
+	prev, hasTTL := s.ttlMap[k]
+	if !hasTTL {
+		atomic.AddUint64(&s.ttlCount, 1)
+	}
+
+	s.ttlMap[k] = expiration
+
+	// Update the nearest expire.
+	s.nearestExpire = earliest(s.nearestExpire, expiration)
+	s.scanNearest = earliest(s.scanNearest, expiration)
+
+	return prev, hasTTL
+}
+
+// setExpirations sets the expiration of each of keys
+// for a TTL of t seconds (including any jitter), taking
+// the ttlLock and updating the nearest expiration once.
+// The shard must be locked.
+func (s *Shard) setExpirations(keys []string, t int32) {
+	if len(keys) == 0 {
+		return
+	}
+
+	expirations := make([]time.Time, len(keys))
+	nearest := noExpire
+	for i := range keys {
+		expirations[i] = s.expiration(t)
+		nearest = earliest(nearest, expirations[i])
+	}
+
+	s.ttlLock.Lock()
+	defer s.ttlLock.Unlock()
+
+	var added uint64
+	for i, k := range keys {
+		if _, hasTTL := s.ttlMap[k]; !hasTTL {
+			added++
+		}
+		s.ttlMap[k] = expirations[i]
+	}
+
+	atomic.AddUint64(&s.ttlCount, added)
+
+	s.nearestExpire = earliest(s.nearestExpire, nearest)
+	s.scanNearest = earliest(s.scanNearest, nearest)
+}
+
+// expireDue evicts key k if its TTL has expired.
+// The TTL is checked under the ttlLock so that the
+// shard lock is only taken if k is expired.
+func (s *Shard) expireDue(k string) {
+	s.ttlLock.Lock()
+	ttl, hasTTL := s.ttlMap[k]
+	s.ttlLock.Unlock()
+
+	if !hasTTL || s.clock.Now().Before(ttl) {
+		return
+	}
+
+	s.Lock()
+
+	// Recheck in case the TTL
+	// was reset in the meantime.
+	if ttl, hasTTL := s.ttlMap[k]; hasTTL && !s.clock.Now().Before(ttl) {
+		s.evictKeys([]string{k}, EvictReasonTTL)
+	}
+
+	s.Unlock()
+}
+
+// deleteExpiration removes the TTL expiration
+// for key k. The shard must be write locked.
+func (s *Shard) deleteExpiration(k string) {
+	s.ttlLock.Lock()
+	delete(s.ttlMap, k)
+	s.ttlLock.Unlock()
+}
+
+// expiresBefore returns whether the shard's
+// nearest TTL expiration is before t. A shard
+// at noExpire never expires before t.
+func (s *Shard) expiresBefore(t time.Time) bool {
+	s.ttlLock.Lock()
+	defer s.ttlLock.Unlock()
+
+	return !s.nearestExpire.IsZero() && s.nearestExpire.Before(t)
+}
+
+// noExpire is the nearestExpire sentinel for
+// shards with no pending TTL expirations. The
+// zero time can't collide with a real expiration,
+// regardless of how long a TTL is.
+var noExpire time.Time
+
+// earliest returns the earlier of
+// expirations a and b, where noExpire
+// is later than any real expiration.
+func earliest(a, b time.Time) time.Time {
+	switch {
+	case a.IsZero():
+		return b
+	case b.IsZero():
+		return a
+	case b.Before(a):
+		return b
+	}
+
+	return a
+}
+
+// syncTTLCount sets the ttlCount to the
+// number of TTL'd keys for paths that remove
+// keys outside of evictions. The shard must
+// be locked.
+func (s *Shard) syncTTLCount() {
+	atomic.StoreUint64(&s.ttlCount, uint64(len(s.ttlMap)))
+}
+
 // decrementTTLCount decrements the Bicache.ttlCount
 // value by n. Even though these operations are atomic,
 // this method should only be called when the shard is locked
@@ -4,7 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
+	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -34,6 +39,412 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewInvalidConfig(t *testing.T) {
+	if _, err := bicache.New(nil); err == nil {
+		t.Error("Expected error for nil config")
+	}
+
+	configs := []*bicache.Config{
+		// Not a power of 2.
+		{MRUSize: 10, ShardCount: 3},
+		// Negative shard counts.
+		{MRUSize: 10, ShardCount: -2},
+		{MRUSize: 10, ShardCount: math.MinInt},
+		// No capacity.
+		{ShardCount: 2},
+		// Sizes that would overflow.
+		{MFUSize: math.MaxUint, MRUSize: 10, ShardCount: 2},
+		{MRUSize: math.MaxUint / 2, ShardCount: 1},
+		{MRUSize: 10, InitialCapacity: math.MaxUint},
+	}
+
+	for _, config := range configs {
+		if _, err := bicache.New(config); err == nil {
+			t.Errorf("Expected error for config %+v", *config)
+		}
+	}
+
+	c, _ := bicache.New(&bicache.Config{MRUSize: 10, ShardCount: 2})
+	if err := c.Reconfigure(nil); err == nil {
+		t.Error("Expected error for nil config")
+	}
+
+	// Small sizes over many shards
+	// round up to one key per shard.
+	c, err := bicache.New(&bicache.Config{MFUSize: 1, MRUSize: 1, ShardCount: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Size != 2048 {
+		t.Errorf("Expected size 2048, got %d", c.Size)
+	}
+}
+
+func TestInitialCapacity(t *testing.T) {
+	// The hint only sizes preallocation; caches
+	// hold their full capacity either way, including
+	// after a flush reallocates the shard maps.
+	for _, hint := range []uint{1, 40, 10000} {
+		c, err := bicache.New(&bicache.Config{
+			MFUSize:         10,
+			MRUSize:         30,
+			ShardCount:      4,
+			AutoEvict:       60000,
+			InitialCapacity: hint,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for flush := 0; flush < 2; flush++ {
+			for i := 0; i < 40; i++ {
+				c.Set(strconv.Itoa(i), i)
+			}
+
+			for i := 0; i < 40; i++ {
+				if v := c.Get(strconv.Itoa(i)); v != i {
+					t.Errorf("Expected value %d with hint %d, got %v", i, hint, v)
+				}
+			}
+
+			if err := c.Validate(); err != nil {
+				t.Error(err)
+			}
+
+			c.FlushAll()
+		}
+	}
+}
+
+func TestNewMFUOnly(t *testing.T) {
+	// At least one of the MFU or MRU
+	// must be sized.
+	if _, err := bicache.New(&bicache.Config{ShardCount: 1}); err == nil {
+		t.Error("Expected error for unsized cache")
+	}
+
+	c, err := bicache.New(&bicache.Config{
+		MFUSize:    4,
+		MRUSize:    0,
+		ShardCount: 1,
+		AutoEvict:  1000,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if !c.Set(strconv.Itoa(i), "value") {
+			t.Errorf("Set failed for key %d", i)
+		}
+	}
+
+	// Keys 4 and 5 are left cold.
+	for i := 0; i < 4; i++ {
+		c.Get(strconv.Itoa(i))
+		c.Get(strconv.Itoa(i))
+	}
+
+	log.Printf("Sleeping for 2 seconds to allow evictions")
+	time.Sleep(2 * time.Second)
+
+	stats := c.Stats()
+
+	if stats.MFUSize != 4 {
+		t.Errorf("Expected MFU size 4, got %d", stats.MFUSize)
+	}
+
+	if stats.MRUSize != 0 || stats.MRUUsedP != 0 {
+		t.Errorf("Expected MRU size 0, got %d", stats.MRUSize)
+	}
+
+	for i := 0; i < 4; i++ {
+		if c.Get(strconv.Itoa(i)) == nil {
+			t.Errorf("Unexpected miss for key %d", i)
+		}
+	}
+
+	for _, k := range []string{"4", "5"} {
+		if c.Get(k) != nil {
+			t.Errorf(`Expected key "%s" to be evicted`, k)
+		}
+	}
+}
+
+func TestNewMFUDisabled(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    0,
+		MRUSize:    64,
+		ShardCount: 16,
+		AutoEvict:  60000,
+	})
+
+	if bicache.MFUAllocated(c) {
+		t.Error("Expected no MFU lists to be allocated")
+	}
+
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), "value")
+		c.Get(strconv.Itoa(i))
+	}
+
+	c.SyncEvict()
+	c.FlushMFU()
+
+	if n := len(c.HotKeys(5)); n != 5 {
+		t.Errorf("Expected 5 hot keys, got %d", n)
+	}
+
+	if c.EvictLFU(5) != 5 || c.EvictLRU(5) != 5 {
+		t.Error("Unexpected eviction count")
+	}
+
+	if stats := c.Stats(); stats.MFUSize != 0 || stats.MRUSize != 54 {
+		t.Errorf("Unexpected sizes %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	// Enabling the MFU allocates it.
+	c.Reconfigure(&bicache.Config{MFUSize: 16, MRUSize: 64, AutoEvict: 60000})
+
+	if !bicache.MFUAllocated(c) {
+		t.Error("Expected MFU lists to be allocated")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	if err := c.Reconfigure(&bicache.Config{MRUSize: 30, ShardCount: 2}); err == nil {
+		t.Error("Expected error for changed shard count")
+	}
+
+	// Shrink the MRU and move
+	// evictions to each Set.
+	err := c.Reconfigure(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    5,
+		NoOverflow: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.Stats()
+
+	if stats.MFUMaxSize != 10 || stats.MRUMaxSize != 5 {
+		t.Errorf("Expected MFU/MRU max sizes 10/5, got %d/%d", stats.MFUMaxSize, stats.MRUMaxSize)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	stats = c.Stats()
+
+	if stats.MRUSize != 5 {
+		t.Errorf("Expected MRU size 5, got %d", stats.MRUSize)
+	}
+
+	if stats.Overflows != 5 {
+		t.Errorf("Expected 5 overflows, got %d", stats.Overflows)
+	}
+
+	// Promote keys to the MFU, then disable it.
+	if err := c.Reconfigure(&bicache.Config{MFUSize: 10, MRUSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+		if i < 5 {
+			c.Get(strconv.Itoa(i))
+			c.Get(strconv.Itoa(i))
+		}
+	}
+
+	c.SyncEvict()
+
+	if stats = c.Stats(); stats.MFUSize != 5 {
+		t.Fatalf("Expected MFU size 5, got %d", stats.MFUSize)
+	}
+
+	if err := c.Reconfigure(&bicache.Config{MRUSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SyncEvict()
+
+	stats = c.Stats()
+
+	if stats.MFUSize != 0 || stats.MRUSize != 5 {
+		t.Errorf("Expected MFU/MRU sizes 0/5, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	// Disabling the MRU moves its keys
+	// to the MFU, evicting the overflow.
+	if err := c.Reconfigure(&bicache.Config{MFUSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats = c.Stats(); stats.MFUSize != 5 || stats.MRUSize != 0 {
+		t.Errorf("Expected MFU/MRU sizes 5/0, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	c.SyncEvict()
+
+	if stats = c.Stats(); stats.MFUSize != 3 || stats.MRUSize != 0 {
+		t.Errorf("Expected MFU/MRU sizes 3/0, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetNoOverflow(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    10,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		NoOverflow: true,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if c.Set("10", "value") {
+		t.Error("Expected set on full cache to fail")
+	}
+
+	// Allow overflow mid-load.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Set("load"+strconv.Itoa(i), "value")
+		}
+	}()
+
+	if err := c.SetNoOverflow(false); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	if !c.Set("11", "value") {
+		t.Error("Expected set with overflow allowed to succeed")
+	}
+
+	// Restore strict capacity.
+	c.SetNoOverflow(true)
+	c.SyncEvict()
+
+	if c.Set("12", "value") {
+		t.Error("Expected set on full cache to fail")
+	}
+
+	if stats := c.Stats(); stats.MRUSize != 10 {
+		t.Errorf("Expected MRU size 10, got %d", stats.MRUSize)
+	}
+
+	c, _ = bicache.New(&bicache.Config{MRUSize: 10, OverflowEvict: true})
+	if err := c.SetNoOverflow(true); err == nil {
+		t.Error("Expected error with NoOverflow and OverflowEvict")
+	}
+}
+
+func TestCloneEmpty(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  60000,
+		NoOverflow: true,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.Reconfigure(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    6,
+		AutoEvict:  60000,
+		NoOverflow: true,
+	})
+
+	clone, err := c.CloneEmpty()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.Stats().MFUMaxSize + c.Stats().MRUMaxSize
+	if clone.ShardCount != c.ShardCount || uint(clone.Size) != size {
+		t.Errorf("Expected shard count %d and size %d, got %d and %d",
+			c.ShardCount, size, clone.ShardCount, clone.Size)
+	}
+
+	if n := len(clone.List(100)); n != 0 {
+		t.Errorf("Expected empty clone, got %d keys", n)
+	}
+
+	// The clone has the reconfigured
+	// MRU size and NoOverflow.
+	for i := 0; i < 10; i++ {
+		clone.Set(strconv.Itoa(i), "value")
+	}
+
+	if stats := clone.Stats(); stats.MRUSize != 6 {
+		t.Errorf("Expected MRU size 6, got %d", stats.MRUSize)
+	}
+
+	// Closing the original
+	// doesn't affect the clone.
+	c.Close()
+	clone.Del("0")
+
+	if !clone.Set("0", "value") {
+		t.Error("Expected set on clone to succeed")
+	}
+}
+
+func TestDeferredOverflows(t *testing.T) {
+	for _, autoEvict := range []uint{0, 60000} {
+		c, _ := bicache.New(&bicache.Config{
+			MRUSize:    5,
+			ShardCount: 1,
+			AutoEvict:  autoEvict,
+		})
+
+		for i := 0; i < 7; i++ {
+			c.Set(strconv.Itoa(i), "value")
+		}
+
+		// Updates aren't overflows.
+		c.Set("6", "value")
+
+		var expected uint64
+		if autoEvict > 0 {
+			expected = 2
+		}
+
+		if n := c.Stats().DeferredOverflows; n != expected {
+			t.Errorf("Expected %d deferred overflows, got %d", expected, n)
+		}
+	}
+}
+
 func TestStats(t *testing.T) {
 	c, _ := bicache.New(&bicache.Config{
 		MFUSize:    10,
@@ -138,86 +549,972 @@ func TestStats(t *testing.T) {
 	}
 }
 
-func TestEvictTtl(t *testing.T) {
+func TestStatsRejections(t *testing.T) {
 	c, _ := bicache.New(&bicache.Config{
-		MFUSize:    10,
-		MRUSize:    30,
-		ShardCount: 2,
-		AutoEvict:  1000,
+		MRUSize:    2,
+		ShardCount: 1,
+		NoOverflow: true,
 	})
 
-	c.SetTTL("5", "value", 5)
-	c.SetTTL("30", "value", 30)
+	c.Set("0", "value")
+	c.Set("1", "value")
+	c.Set("2", "value")
 
-	if v := c.Get("5"); v != "value" {
-		t.Error("Expected hit")
+	c.Close()
+
+	if c.Set("3", "value") {
+		t.Error("Expected set on closed cache to fail")
 	}
 
-	log.Printf("Sleeping for 6 seconds to allow evictions")
-	time.Sleep(6 * time.Second)
+	stats := c.Stats()
 
-	// Check that the value was evicted.
-	if v := c.Get("5"); v != nil {
-		t.Error("Expected miss")
+	if stats.Overflows != 1 {
+		t.Errorf("Expected 1 overflows, got %d", stats.Overflows)
 	}
 
-	stats := c.Stats()
+	if stats.Closed != 1 {
+		t.Errorf("Expected 1 closed, got %d", stats.Closed)
+	}
 
-	if stats.MRUSize != 1 || stats.Evictions != 1 {
-		t.Error("Unexpected stats")
+	if stats.Rejections != 2 {
+		t.Errorf("Expected 2 rejections, got %d", stats.Rejections)
 	}
 }
 
-func TestPromoteEvict(t *testing.T) {
-	// Also covers MRU tail eviction.
+func TestStatsPaused(t *testing.T) {
 	c, _ := bicache.New(&bicache.Config{
-		MFUSize:    10,
 		MRUSize:    30,
 		ShardCount: 2,
-		AutoEvict:  5000,
+		AutoEvict:  10000,
 	})
 
-	for i := 0; i < 50; i++ {
-		c.Set(strconv.Itoa(i), "value")
+	if c.Stats().Paused {
+		t.Error("Expected evictions not to be paused")
 	}
 
-	c.Get("0")
-	c.Get("0")
-	c.Get("0")
-	c.Get("0")
+	c.Pause()
 
-	c.Get("1")
-	c.Get("1")
-	c.Get("1")
+	if !c.Stats().Paused {
+		t.Error("Expected evictions to be paused")
+	}
 
-	c.Get("2")
-	c.Get("2")
-	c.Get("2")
-	c.Get("2")
-	c.Get("2")
-	c.Get("2")
+	c.Resume()
 
-	log.Printf("Sleeping for 6 seconds to allow evictions")
-	time.Sleep(6 * time.Second)
+	if c.Stats().Paused {
+		t.Error("Expected evictions not to be paused")
+	}
+}
 
-	stats := c.Stats()
+func TestStatsDetailed(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
 
-	if stats.MFUSize != 3 {
-		t.Error("Unexpected MFU count")
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
 	}
 
-	if stats.MRUSize != 30 {
-		t.Error("Unexpected MRU count")
+	for i := 0; i < 3; i++ {
+		c.Get(strconv.Itoa(i))
 	}
 
-	// Check that the expected MRU members exist.
-	for k := 20; k <= 49; k++ {
-		if v := c.Get(strconv.Itoa(k)); v == nil {
-			t.Errorf("Unexpected miss for key %d", k)
+	stats := c.StatsDetailed()
+
+	if stats.ColdKeys != 7 {
+		t.Errorf("Expected 7 cold keys, got %d", stats.ColdKeys)
+	}
+
+	if stats.MRUSize != 10 || stats.Hits != 3 {
+		t.Errorf("Expected MRU size 10 and 3 hits, got %d and %d", stats.MRUSize, stats.Hits)
+	}
+
+	// Score quantiles.
+	c, _ = bicache.New(&bicache.Config{
+		MRUSize:    100,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		c.Set(k, "value")
+		for j := 0; j < i; j++ {
+			c.Get(k)
 		}
 	}
 
-	// Check that the expected MFU members exist.
+	stats = c.StatsDetailed()
+
+	if stats.MedianScore != 50 || stats.P99Score != 99 {
+		t.Errorf("Expected median and p99 scores 50 and 99, got %d and %d", stats.MedianScore, stats.P99Score)
+	}
+}
+
+func TestWarmRatio(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	if r := c.WarmRatio(); r != 0 {
+		t.Errorf("Expected warm ratio 0, got %f", r)
+	}
+
+	for i := 0; i < 20; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if r := c.WarmRatio(); r != 0.5 {
+		t.Errorf("Expected warm ratio 0.5, got %f", r)
+	}
+
+	if !c.IsWarm(0.5) {
+		t.Error("Expected cache to be warm at 0.5")
+	}
+
+	if c.IsWarm(0.6) {
+		t.Error("Expected cache not to be warm at 0.6")
+	}
+
+	// Over capacity
+	// reports 1.
+	for i := 20; i < 50; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if r := c.WarmRatio(); r != 1 {
+		t.Errorf("Expected warm ratio 1, got %f", r)
+	}
+}
+
+func TestStatsDelta(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    30,
+		ShardCount: 2,
+	})
+
+	c.Set("0", "value")
+	c.Get("0")
+
+	// Backdate the previous
+	// snapshot by 10 seconds.
+	prev := c.Stats()
+	prev.Time = prev.Time.Add(-10 * time.Second)
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+		c.Get(strconv.Itoa(i))
+		c.Get("missing")
+	}
+
+	if n := c.Stats().Sets; n != 11 {
+		t.Errorf("Expected 11 sets, got %d", n)
+	}
+
+	d := c.StatsDelta(prev)
+
+	if d.Interval < 10*time.Second {
+		t.Errorf("Expected an interval of at least 10s, got %s", d.Interval)
+	}
+
+	// 10 each of sets, hits and
+	// misses over ~10 seconds.
+	rates := map[string][2]float64{
+		"Sets":   {d.Sets, 1},
+		"Hits":   {d.Hits, 1},
+		"Misses": {d.Misses, 1},
+	}
+
+	for name, r := range rates {
+		if r[0] > r[1] || r[0] < r[1]*0.9 {
+			t.Errorf("Expected %s rate of ~%.1f/s, got %.2f", name, r[1], r[0])
+		}
+	}
+
+	if d.Evictions != 0 {
+		t.Errorf("Expected eviction rate of 0, got %.2f", d.Evictions)
+	}
+
+	// No elapsed time yields 0 rates.
+	stats := c.Stats()
+	if d := c.StatsDelta(&bicache.Stats{Time: stats.Time.Add(time.Hour)}); d.Hits != 0 {
+		t.Errorf("Expected hit rate of 0, got %.2f", d.Hits)
+	}
+}
+
+func TestTTLCount(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  60000,
+	})
+
+	c.Set("permanent", "value")
+	c.SetTTL("ttl1", "value", 60)
+	c.SetTTL("ttl2", "value", 60)
+	// Resetting a TTL doesn't change the count.
+	c.SetTTL("ttl2", "value", 120)
+	c.SetTTL("expired", "value", -1)
+
+	if n := c.TTLCount(); n != 3 {
+		t.Errorf("Expected TTL count 3, got %d", n)
+	}
+
+	c.Del("ttl1")
+	c.SyncEvict()
+
+	if n := c.Stats().TTLKeys; n != 1 {
+		t.Errorf("Expected 1 TTL key, got %d", n)
+	}
+
+	c.FlushAll()
+
+	if n := c.TTLCount(); n != 0 {
+		t.Errorf("Expected TTL count 0, got %d", n)
+	}
+}
+
+func TestLastEvictCycle(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  500,
+	})
+
+	if !c.LastEvictCycle().IsZero() {
+		t.Error("Expected zero last evict cycle")
+	}
+
+	log.Printf("Sleeping for 1 second to allow evictions")
+	time.Sleep(time.Second)
+
+	if last := c.LastEvictCycle(); time.Since(last) > time.Second {
+		t.Errorf("Unexpected last evict cycle %s", last)
+	}
+}
+
+func TestEvictCyclePanic(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    2,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		OnEvict: func(k string, v interface{}) {
+			panic("evict " + k)
+		},
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	// Run the eviction cycle synchronously
+	// rather than racing the background task.
+	c.SyncEvict()
+
+	// The panicking hook doesn't
+	// leave the shard locked.
+	done := make(chan struct{})
+	go func() {
+		c.Set("key", "value")
+		c.Get("key")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Shard left locked after a hook panic")
+	}
+
+	stats := c.Stats()
+
+	if stats.HookPanics != 8 {
+		t.Errorf("Expected 8 hook panics, got %d", stats.HookPanics)
+	}
+
+	if c.LastEvictCycle().IsZero() {
+		t.Error("Expected eviction cycles to complete")
+	}
+}
+
+func TestPressure(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    10,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	c.SyncEvict()
+
+	if p := c.Pressure(); p != 0 {
+		t.Errorf("Expected pressure 0, got %f", p)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.SyncEvict()
+
+	if p := c.Pressure(); p != 0.5 {
+		t.Errorf("Expected pressure 0.5, got %f", p)
+	}
+
+	// Evict the cache capacity.
+	for i := 10; i < 20; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.SyncEvict()
+
+	if p := c.Pressure(); p != 1 {
+		t.Errorf("Expected pressure 1, got %f", p)
+	}
+
+	if rate := c.Stats().EvictionRate; rate <= 0 {
+		t.Errorf("Expected a positive eviction rate, got %f", rate)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+	})
+
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		if i%3 == 0 {
+			c.SetTTL(k, "value", 60)
+		} else {
+			c.Set(k, "value")
+		}
+
+		for j := 0; j < i%5; j++ {
+			c.Get(k)
+		}
+
+		if i%7 == 0 {
+			c.Del(strconv.Itoa(i / 2))
+		}
+	}
+
+	c.Promote("99")
+	c.Demote("98")
+	c.SyncEvict()
+
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	c.Set("key", "value")
+	bicache.SetEntryState(c, "key", 1)
+
+	if err := c.Validate(); err == nil {
+		t.Error("Expected error for corrupted entry state")
+	}
+}
+
+func TestDebugEntryCheck(t *testing.T) {
+	out := &lockedBuilder{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		Debug:      true,
+	})
+
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		c.Set(k, "value")
+
+		for j := 0; j < i%5; j++ {
+			c.Get(k)
+		}
+
+		if i%7 == 0 {
+			c.Del(strconv.Itoa(i / 2))
+		}
+	}
+
+	if out.String() != "" {
+		t.Fatalf("Unexpected log output:\n%s", out)
+	}
+
+	// A corrupted entry
+	// is logged on get.
+	c.Set("key", "value")
+	bicache.SetEntryState(c, "key", 1)
+	c.Get("key")
+
+	if !strings.Contains(out.String(), "key key in state 1") {
+		t.Errorf("Expected inconsistent entry log, got:\n%s", out)
+	}
+}
+
+// lockedBuilder is a strings.Builder
+// safe for use as a log output.
+type lockedBuilder struct {
+	sync.Mutex
+	strings.Builder
+}
+
+func (lb *lockedBuilder) Write(p []byte) (int, error) {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.Builder.Write(p)
+}
+
+func (lb *lockedBuilder) String() string {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.Builder.String()
+}
+
+func TestEvictLogIdle(t *testing.T) {
+	out := &lockedBuilder{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	// Without an MFU, the background
+	// task only reads the shards under
+	// their locks while keys are set.
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  50,
+		EvictLog:   true,
+	})
+	defer c.Close()
+
+	c.Set("key", "value")
+
+	time.Sleep(300 * time.Millisecond)
+
+	if strings.Contains(out.String(), "[Bicache PromoteEvict]") {
+		t.Errorf("Unexpected eviction log lines with no activity:\n%s", out)
+	}
+
+	// Overflow the MRU.
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if !strings.Contains(out.String(), "[Bicache PromoteEvict]") {
+		t.Error("Expected eviction log line")
+	}
+}
+
+func TestSyncEvict(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  60000,
+	})
+
+	for i := 0; i < 50; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.SetTTL("expired", "value", -1)
+
+	c.SyncEvict()
+
+	stats := c.Stats()
+
+	if stats.MRUSize != 30 {
+		t.Errorf("Expected MRU size 30, got %d", stats.MRUSize)
+	}
+
+	if stats.Evictions != 21 {
+		t.Errorf("Expected 21 evictions, got %d", stats.Evictions)
+	}
+}
+
+func TestStatsLockWait(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:       10,
+		MRUSize:       30,
+		ShardCount:    2,
+		LockWaitStats: true,
+	})
+
+	c.Set("key", "value")
+
+	for i := 0; i < 100; i++ {
+		c.Get("key")
+	}
+
+	stats := c.Stats()
+
+	if stats.LockWaitP99 < stats.LockWaitP50 {
+		t.Errorf("Unexpected lock wait p50/p99 %s/%s", stats.LockWaitP50, stats.LockWaitP99)
+	}
+
+	if stats.LockWaitP99 == 0 {
+		t.Error("Expected non-zero lock wait p99")
+	}
+
+	// Stats may be read while
+	// gets record lock waits.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Get("key")
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Stats()
+	}
+
+	wg.Wait()
+}
+
+func TestStatsUsedP(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  60000,
+	})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(4)
+
+	// Fill well beyond capacity
+	// while polling stats.
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Set(fmt.Sprintf("%d-%d", i, j), "value")
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		stats := c.Stats()
+		if stats.MRUUsedP > 100 || stats.MFUUsedP > 100 {
+			t.Fatalf("Used percent exceeds 100: MRU %d, MFU %d", stats.MRUUsedP, stats.MFUUsedP)
+		}
+
+		select {
+		case <-done:
+			if stats := c.Stats(); stats.MRUUsedP != 100 {
+				t.Errorf("Expected MRU usedp 100, got %d", stats.MRUUsedP)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestOnOverCapacity(t *testing.T) {
+	var calls, maxOver int
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    5,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		OnOverCapacity: func(shard int, overBy int) {
+			calls++
+			if overBy > maxOver {
+				maxOver = overBy
+			}
+		},
+	})
+
+	for i := 0; i < 8; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if calls != 3 || maxOver != 3 {
+		t.Errorf("Expected 3 calls with max over 3, got %d calls with max over %d", calls, maxOver)
+	}
+}
+
+func TestEvictTtl(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  1000,
+	})
+
+	c.SetTTL("5", "value", 5)
+	c.SetTTL("30", "value", 30)
+
+	if v := c.Get("5"); v != "value" {
+		t.Error("Expected hit")
+	}
+
+	log.Printf("Sleeping for 6 seconds to allow evictions")
+	time.Sleep(6 * time.Second)
+
+	// Check that the value was evicted.
+	if v := c.Get("5"); v != nil {
+		t.Error("Expected miss")
+	}
+
+	stats := c.Stats()
+
+	if stats.MRUSize != 1 || stats.Evictions != 1 {
+		t.Error("Unexpected stats")
+	}
+}
+
+// fakeClock is a bicache.Clock
+// that's advanced manually.
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.Lock()
+	fc.now = fc.now.Add(d)
+	fc.Unlock()
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  60000,
+		Clock:      clock,
+	})
+
+	c.SetTTL("short", "value", 5)
+	c.SetTTL("long", "value", 60)
+	c.Set("permanent", "value")
+
+	clock.Advance(10 * time.Second)
+	c.SyncEvict()
+
+	if c.Get("short") != nil {
+		t.Error("Expected key short to be expired")
+	}
+
+	if c.Get("long") == nil {
+		t.Error("Expected key long to exist")
+	}
+
+	clock.Advance(time.Minute)
+	c.SyncEvict()
+
+	if c.Get("long") != nil {
+		t.Error("Expected key long to be expired")
+	}
+
+	if c.Get("permanent") == nil {
+		t.Error("Expected key permanent to exist")
+	}
+}
+
+func TestTTLNearestExpire(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		Clock:      clock,
+	})
+
+	c.SetTTL("long", "value", 60)
+	c.SyncEvict()
+
+	// A shorter TTL set after a scan must
+	// pull the nearest expiration forward.
+	c.SetTTL("short", "value", 5)
+	clock.Advance(10 * time.Second)
+	c.SyncEvict()
+
+	if c.Get("short") != nil {
+		t.Error("Expected key short to be expired")
+	}
+
+	// An expired key with a reset TTL
+	// must not be evicted.
+	c.SetTTL("reset", "value", 5)
+	clock.Advance(10 * time.Second)
+	c.SetTTL("reset", "value", 60)
+	c.SyncEvict()
+
+	if c.Get("reset") == nil {
+		t.Error("Expected key reset to exist")
+	}
+
+	clock.Advance(2 * time.Minute)
+	c.SyncEvict()
+
+	if c.Get("long") != nil || c.Get("reset") != nil {
+		t.Error("Expected keys long and reset to be expired")
+	}
+
+	if n := c.TTLCount(); n != 0 {
+		t.Errorf("Expected TTL count 0, got %d", n)
+	}
+}
+
+func TestManualModeEnforcement(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	goroutines := runtime.NumGoroutine()
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    10,
+		ShardCount: 1,
+		Clock:      clock,
+	})
+
+	if n := runtime.NumGoroutine(); n != goroutines {
+		t.Errorf("Expected no background goroutines, got %d", n-goroutines)
+	}
+
+	c.SetTTL("short", "value", 5)
+	c.SetTTL("long", "value", 60)
+	clock.Advance(10 * time.Second)
+
+	// Expired keys are evicted on read.
+	if c.Get("short") != nil {
+		t.Error("Expected key short to be expired")
+	}
+
+	if c.Get("long") == nil {
+		t.Error("Expected key long to exist")
+	}
+
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Misses != 1 || stats.TTLKeys != 1 {
+		t.Errorf("Expected 1 eviction, miss and TTL key, got %d, %d and %d",
+			stats.Evictions, stats.Misses, stats.TTLKeys)
+	}
+
+	clock.Advance(time.Minute)
+
+	if v := c.MultiGet([]string{"long"}); v[0] != nil {
+		t.Error("Expected key long to be expired")
+	}
+
+	// Capacity is enforced on write.
+	for i := 0; i < 25; i++ {
+		c.Set(strconv.Itoa(i), "value")
+
+		if n := c.Stats().MRUSize; n > 10 {
+			t.Fatalf("Expected at most 10 keys, got %d", n)
+		}
+	}
+}
+
+func TestTTLMaxExpire(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		Clock:      clock,
+	})
+
+	// The longest possible TTL must
+	// still be tracked as the nearest
+	// expiration and not evicted early.
+	c.SyncEvict()
+	c.SetTTL("max", "value", math.MaxInt32)
+	clock.Advance(time.Hour)
+	c.SyncEvict()
+
+	if c.Get("max") == nil {
+		t.Error("Expected key max to exist")
+	}
+
+	c.SetTTL("short", "value", 5)
+	clock.Advance(10 * time.Second)
+	c.SyncEvict()
+
+	if c.Get("short") != nil {
+		t.Error("Expected key short to be expired")
+	}
+
+	if c.Get("max") == nil {
+		t.Error("Expected key max to exist")
+	}
+
+	clock.Advance(math.MaxInt32 * time.Second)
+	c.SyncEvict()
+
+	if c.Get("max") != nil {
+		t.Error("Expected key max to be expired")
+	}
+
+	if n := c.TTLCount(); n != 0 {
+		t.Errorf("Expected TTL count 0, got %d", n)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    300,
+		ShardCount: 2,
+		AutoEvict:  10000,
+		TTLJitter:  5 * time.Second,
+	})
+
+	for i := 0; i < 100; i++ {
+		c.SetTTL(strconv.Itoa(i), "value", 10)
+	}
+
+	expiring := c.ExpiringWithin(15 * time.Second)
+
+	if len(expiring) != 100 {
+		t.Fatalf("Expected 100 expiring keys, got %d", len(expiring))
+	}
+
+	// Check that expirations fall within
+	// [ttl, ttl+jitter) and are spread out.
+	for _, k := range expiring {
+		if k.TTL < 9*time.Second || k.TTL >= 15*time.Second {
+			t.Errorf("Remaining TTL %s outside of jitter range", k.TTL)
+		}
+	}
+
+	if expiring[len(expiring)-1].TTL-expiring[0].TTL < time.Second {
+		t.Error("Expected jittered expirations to be spread out")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	expirations := func(seed int64) map[string]time.Duration {
+		c, _ := bicache.New(&bicache.Config{
+			MRUSize:    300,
+			ShardCount: 2,
+			AutoEvict:  10000,
+			TTLJitter:  5 * time.Second,
+			Clock:      clock,
+			Seed:       seed,
+		})
+
+		for i := 0; i < 100; i++ {
+			c.SetTTL(strconv.Itoa(i), "value", 10)
+		}
+
+		ttls := map[string]time.Duration{}
+		for _, k := range c.ExpiringWithin(15 * time.Second) {
+			ttls[k.Key] = k.TTL
+		}
+
+		return ttls
+	}
+
+	// The same seed produces
+	// the same jittered TTLs.
+	a, b := expirations(1), expirations(1)
+	for k, ttl := range a {
+		if b[k] != ttl {
+			t.Errorf(`Expected key "%s" TTL %s, got %s`, k, ttl, b[k])
+		}
+	}
+
+	var differ bool
+	for k, ttl := range expirations(2) {
+		if a[k] != ttl {
+			differ = true
+		}
+	}
+
+	if !differ {
+		t.Error("Expected different seeds to produce different TTLs")
+	}
+}
+
+func TestPromoteEvict(t *testing.T) {
+	// Also covers MRU tail eviction.
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  5000,
+	})
+
+	for i := 0; i < 50; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.Get("0")
+	c.Get("0")
+	c.Get("0")
+	c.Get("0")
+
+	c.Get("1")
+	c.Get("1")
+	c.Get("1")
+
+	c.Get("2")
+	c.Get("2")
+	c.Get("2")
+	c.Get("2")
+	c.Get("2")
+	c.Get("2")
+
+	log.Printf("Sleeping for 6 seconds to allow evictions")
+	time.Sleep(6 * time.Second)
+
+	stats := c.Stats()
+
+	if stats.MFUSize != 3 {
+		t.Error("Unexpected MFU count")
+	}
+
+	if stats.MRUSize != 30 {
+		t.Error("Unexpected MRU count")
+	}
+
+	// Check that the expected MRU members exist.
+	for k := 20; k <= 49; k++ {
+		if v := c.Get(strconv.Itoa(k)); v == nil {
+			t.Errorf("Unexpected miss for key %d", k)
+		}
+	}
+
+	// Check that the expected MFU members exist.
 	for _, k := range []int{0, 1, 2} {
 		if v := c.Get(strconv.Itoa(k)); v == nil {
 			t.Errorf("Unexpected miss for key %d", k)
@@ -225,6 +1522,670 @@ func TestPromoteEvict(t *testing.T) {
 	}
 }
 
+func TestEvictMFUFirst(t *testing.T) {
+	for _, mfuFirst := range []bool{false, true} {
+		c, _ := bicache.New(&bicache.Config{
+			MFUSize:       2,
+			MRUSize:       2,
+			ShardCount:    1,
+			EvictMFUFirst: mfuFirst,
+		})
+
+		// Promote a and b to the MFU.
+		for _, k := range []string{"a", "b", "c", "d"} {
+			c.Set(k, "value")
+			if k == "b" {
+				for i := 0; i < 3; i++ {
+					c.Get("a")
+					c.Get("b")
+				}
+			}
+		}
+
+		if stats := c.Stats(); stats.MFUSize != 2 {
+			t.Fatalf("Expected MFU size 2, got %d", stats.MFUSize)
+		}
+
+		// Overflow the MRU.
+		c.Set("e", "value")
+
+		var mfuKeys int
+		for _, k := range c.List(10) {
+			if k.State == 1 && (k.Key == "a" || k.Key == "b") {
+				mfuKeys++
+			}
+		}
+
+		switch {
+		case !mfuFirst && mfuKeys != 2:
+			t.Errorf("Expected 2 original MFU keys, got %d", mfuKeys)
+		case mfuFirst && mfuKeys != 1:
+			t.Errorf("Expected 1 original MFU key, got %d", mfuKeys)
+		}
+
+		if stats := c.Stats(); stats.MFUSize != 2 || stats.MRUSize != 2 {
+			t.Errorf("Expected MFU/MRU sizes 2/2, got %d/%d", stats.MFUSize, stats.MRUSize)
+		}
+	}
+}
+
+func TestCanEvict(t *testing.T) {
+	var vetoAll bool
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    10,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		Mode:       bicache.ModeLRU,
+		CanEvict: func(k string, v interface{}) bool {
+			return k != "0" && !vetoAll
+		},
+	})
+
+	for i := 0; i < 12; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	// The vetoed LRU key is skipped
+	// for the next coldest keys.
+	if c.Get("0") == nil {
+		t.Error(`Expected key "0" to be retained`)
+	}
+
+	for _, k := range []string{"1", "2"} {
+		if c.Get(k) != nil {
+			t.Errorf(`Expected key "%s" to be evicted`, k)
+		}
+	}
+
+	if stats := c.Stats(); stats.MRUSize != 10 || stats.Evictions != 2 {
+		t.Errorf("Expected MRU size 10 and 2 evictions, got %d and %d", stats.MRUSize, stats.Evictions)
+	}
+
+	// Vetoing every key leaves
+	// the MRU over capacity.
+	vetoAll = true
+	c.Set("12", "value")
+
+	if stats := c.Stats(); stats.MRUSize != 11 || stats.Evictions != 2 {
+		t.Errorf("Expected MRU size 11 and 2 evictions, got %d and %d", stats.MRUSize, stats.Evictions)
+	}
+}
+
+func TestOnEvictBatch(t *testing.T) {
+	var batches [][]bicache.EvictedEntry
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    10,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		OnEvictBatch: func(evicted []bicache.EvictedEntry) {
+			batches = append(batches, evicted)
+		},
+	})
+
+	c.SetTTL("ttl", "value", -1)
+	for i := 0; i < 30; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	if len(batches) != 0 {
+		t.Fatalf("Expected 0 batches, got %d", len(batches))
+	}
+
+	c.SyncEvict()
+
+	// TTL and capacity evictions
+	// are each batched.
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 batches, got %d", len(batches))
+	}
+
+	if len(batches[0]) != 1 || batches[0][0].Key != "ttl" || batches[0][0].Reason != bicache.EvictReasonTTL {
+		t.Errorf(`Expected a TTL batch of key "ttl", got %v`, batches[0])
+	}
+
+	if len(batches[1]) != 20 {
+		t.Fatalf("Expected 20 capacity evictions, got %d", len(batches[1]))
+	}
+
+	for i, e := range batches[1] {
+		if e.Key != strconv.Itoa(i) || e.Value != i || e.Reason != bicache.EvictReasonCapacity {
+			t.Errorf("Unexpected evicted entry %v", e)
+		}
+	}
+}
+
+func TestRecoverHooks(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:      10,
+		ShardCount:   1,
+		RecoverHooks: true,
+		OnEvict: func(k string, v interface{}) {
+			panic("evict " + k)
+		},
+		CanEvict: func(k string, v interface{}) bool {
+			panic("can evict " + k)
+		},
+	})
+
+	for i := 0; i < 30; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	stats := c.Stats()
+
+	if stats.MRUSize != 10 {
+		t.Errorf("Expected MRU size of 10, got %d", stats.MRUSize)
+	}
+
+	// Each eviction recovers a CanEvict
+	// and an OnEvict panic.
+	if stats.HookPanics != 40 {
+		t.Errorf("Expected 40 hook panics, got %d", stats.HookPanics)
+	}
+
+	// The shard isn't left locked.
+	c.Set("key", "value")
+	if v := c.Get("key"); v != "value" {
+		t.Errorf(`Expected value "value", got %v`, v)
+	}
+}
+
+func TestEvictDisplaced(t *testing.T) {
+	for _, evictDisplaced := range []bool{false, true} {
+		var evicted []string
+
+		c, _ := bicache.New(&bicache.Config{
+			MFUSize:        1,
+			MRUSize:        2,
+			ShardCount:     1,
+			EvictDisplaced: evictDisplaced,
+			OnEvict: func(k string, v interface{}) {
+				evicted = append(evicted, k)
+			},
+		})
+
+		// Promote a to the MFU.
+		c.Set("a", "value")
+		for i := 0; i < 3; i++ {
+			c.Get("a")
+		}
+		c.Set("b", "value")
+		c.Set("c", "value")
+
+		// Displace a with b.
+		for i := 0; i < 5; i++ {
+			c.Get("b")
+		}
+		c.Set("d", "value")
+
+		for _, k := range c.List(10) {
+			if k.Key == "b" && k.State != 1 {
+				t.Errorf(`Expected key "b" in state 1, got %d`, k.State)
+			}
+		}
+
+		switch evictDisplaced {
+		case false:
+			if c.Get("a") == nil {
+				t.Error(`Expected key "a" to be demoted`)
+			}
+		case true:
+			if c.Get("a") != nil || len(evicted) != 1 || evicted[0] != "a" {
+				t.Error(`Expected key "a" to be evicted`)
+			}
+		}
+	}
+}
+
+func TestTierEvictions(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:        1,
+		MRUSize:        2,
+		ShardCount:     1,
+		EvictDisplaced: true,
+	})
+
+	// Promote a to the MFU.
+	c.Set("a", "value")
+	for i := 0; i < 3; i++ {
+		c.Get("a")
+	}
+	c.Set("b", "value")
+	c.Set("c", "value")
+
+	// Displace and evict a from the MFU.
+	for i := 0; i < 5; i++ {
+		c.Get("b")
+	}
+	c.Set("d", "value")
+
+	// Evict c from the MRU tail.
+	c.Set("e", "value")
+
+	// TTL evictions aren't
+	// counted for either tier.
+	c.SetTTL("e", "value", -1)
+	c.SyncEvict()
+
+	stats := c.Stats()
+
+	if stats.MFUEvictions != 1 || stats.MRUEvictions != 1 {
+		t.Errorf("Expected 1 MFU and 1 MRU eviction, got %d and %d",
+			stats.MFUEvictions, stats.MRUEvictions)
+	}
+
+	if stats.Evictions != 3 {
+		t.Errorf("Expected 3 evictions, got %d", stats.Evictions)
+	}
+}
+
+func TestPromoteOnTie(t *testing.T) {
+	for _, promoteOnTie := range []bool{false, true} {
+		c, _ := bicache.New(&bicache.Config{
+			MFUSize:      1,
+			MRUSize:      2,
+			ShardCount:   1,
+			PromoteOnTie: promoteOnTie,
+		})
+
+		// Promote a to the MFU.
+		c.Set("a", "value")
+		for i := 0; i < 3; i++ {
+			c.Get("a")
+		}
+		c.Set("b", "value")
+		c.Set("c", "value")
+
+		// Tie a's score with b.
+		for i := 0; i < 3; i++ {
+			c.Get("b")
+		}
+		c.Set("d", "value")
+
+		states := map[string]uint8{}
+		for _, k := range c.List(10) {
+			states[k.Key] = k.State
+		}
+
+		switch promoteOnTie {
+		case false:
+			if states["a"] != 1 {
+				t.Errorf(`Expected key "a" in state 1, got %d`, states["a"])
+			}
+			if _, exists := states["b"]; exists {
+				t.Error(`Expected key "b" to be evicted`)
+			}
+		case true:
+			if states["b"] != 1 {
+				t.Errorf(`Expected key "b" in state 1, got %d`, states["b"])
+			}
+			if s, exists := states["a"]; !exists || s != 0 {
+				t.Error(`Expected key "a" to be demoted`)
+			}
+		}
+	}
+}
+
+func TestLowWatermark(t *testing.T) {
+	for _, mode := range []bicache.Mode{bicache.ModeDefault, bicache.ModeLRU} {
+		c, _ := bicache.New(&bicache.Config{
+			MRUSize:      10,
+			ShardCount:   1,
+			AutoEvict:    60000,
+			Mode:         mode,
+			LowWatermark: 0.5,
+		})
+
+		// Filling to capacity
+		// doesn't evict.
+		for i := 0; i < 10; i++ {
+			c.Set(strconv.Itoa(i), "value")
+		}
+
+		c.SyncEvict()
+
+		if stats := c.Stats(); stats.MRUSize != 10 {
+			t.Errorf("Expected MRU size 10, got %d", stats.MRUSize)
+		}
+
+		// Exceeding capacity evicts
+		// down to the low watermark.
+		c.Set("10", "value")
+		c.SyncEvict()
+
+		if stats := c.Stats(); stats.MRUSize != 5 {
+			t.Errorf("Expected MRU size 5, got %d", stats.MRUSize)
+		}
+	}
+
+	if _, err := bicache.New(&bicache.Config{MRUSize: 10, LowWatermark: 1.5}); err == nil {
+		t.Error("Expected error for invalid low watermark")
+	}
+}
+
+func TestOverflowGrace(t *testing.T) {
+	for _, mode := range []bicache.Mode{bicache.ModeDefault, bicache.ModeLRU} {
+		c, _ := bicache.New(&bicache.Config{
+			MRUSize:       10,
+			ShardCount:    1,
+			AutoEvict:     60000,
+			Mode:          mode,
+			OverflowGrace: 1.5,
+		})
+
+		// Exceeding capacity within
+		// the grace doesn't evict.
+		for i := 0; i < 15; i++ {
+			c.Set(strconv.Itoa(i), "value")
+		}
+
+		c.SyncEvict()
+
+		if stats := c.Stats(); stats.MRUSize != 15 {
+			t.Errorf("Expected MRU size 15, got %d", stats.MRUSize)
+		}
+
+		// Exceeding the grace evicts
+		// back down to capacity.
+		c.Set("15", "value")
+		c.SyncEvict()
+
+		if stats := c.Stats(); stats.MRUSize != 10 {
+			t.Errorf("Expected MRU size 10, got %d", stats.MRUSize)
+		}
+	}
+
+	if _, err := bicache.New(&bicache.Config{MRUSize: 10, OverflowGrace: 0.5}); err == nil {
+		t.Error("Expected error for invalid overflow grace")
+	}
+}
+
+func TestModeLRU(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    4,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		Mode:       bicache.ModeLRU,
+	})
+
+	if c.Size != 4 {
+		t.Errorf("Expected bicache size 4, got %d", c.Size)
+	}
+
+	for i := 0; i < 6; i++ {
+		c.Set(strconv.Itoa(i), "value")
+		c.Get(strconv.Itoa(i))
+		c.Get(strconv.Itoa(i))
+	}
+
+	// Evictions happen at each Set,
+	// regardless of AutoEvict.
+	stats := c.Stats()
+	if stats.MRUSize != 4 || stats.MFUSize != 0 {
+		t.Errorf("Expected MFU/MRU sizes 0/4, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	for _, k := range []string{"0", "1"} {
+		if c.Get(k) != nil {
+			t.Errorf(`Expected key "%s" to be evicted`, k)
+		}
+	}
+
+	// There's no MFU to size.
+	if err := c.Reconfigure(&bicache.Config{MFUSize: 4}); err == nil {
+		t.Error("Expected error for MFU-only reconfigure")
+	}
+
+	if err := c.Reconfigure(&bicache.Config{MFUSize: 4, MRUSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	stats = c.Stats()
+	if stats.MRUSize != 4 || stats.MFUSize != 0 {
+		t.Errorf("Expected MFU/MRU sizes 0/4, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+}
+
+func TestModeStrictLRU(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    4,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		Mode:       bicache.ModeStrictLRU,
+	})
+
+	if c.Size != 4 {
+		t.Errorf("Expected bicache size 4, got %d", c.Size)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	// Gets move keys to the MRU
+	// head without scoring them.
+	c.Get("0")
+	c.Get("1")
+
+	c.Set("4", "value")
+	c.Set("5", "value")
+
+	stats := c.Stats()
+	if stats.MRUSize != 4 || stats.MFUSize != 0 {
+		t.Errorf("Expected MFU/MRU sizes 0/4, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	for _, k := range []string{"2", "3"} {
+		if c.Get(k) != nil {
+			t.Errorf(`Expected key "%s" to be evicted`, k)
+		}
+	}
+
+	for _, k := range c.List(4) {
+		if k.Score != 0 {
+			t.Errorf(`Expected key "%s" score 0, got %d`, k.Key, k.Score)
+		}
+	}
+}
+
+func TestModeFIFO(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:      10,
+		MRUSize:      4,
+		ShardCount:   1,
+		AutoEvict:    60000,
+		Mode:         bicache.ModeFIFO,
+		PromoteOnGet: true,
+	})
+
+	if c.Size != 4 {
+		t.Errorf("Expected bicache size 4, got %d", c.Size)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	// Neither gets nor updates
+	// change the eviction order.
+	for i := 0; i < 10; i++ {
+		c.Get("0")
+		c.Get("1")
+	}
+	c.Set("0", "updated")
+
+	c.Set("4", "value")
+	c.Set("5", "value")
+
+	stats := c.Stats()
+	if stats.MRUSize != 4 || stats.MFUSize != 0 {
+		t.Errorf("Expected MFU/MRU sizes 0/4, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	for _, k := range []string{"0", "1"} {
+		if c.Get(k) != nil {
+			t.Errorf(`Expected key "%s" to be evicted`, k)
+		}
+	}
+
+	for _, k := range c.List(4) {
+		if k.Score != 0 {
+			t.Errorf(`Expected key "%s" score 0, got %d`, k.Key, k.Score)
+		}
+	}
+}
+
+func TestOverflowEvict(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:       10,
+		MRUSize:       10,
+		ShardCount:    1,
+		AutoEvict:     60000,
+		OverflowEvict: true,
+	})
+
+	for i := 0; i < 50; i++ {
+		if !c.Set(strconv.Itoa(i), "value") {
+			t.Fatal("Set failed")
+		}
+	}
+
+	stats := c.Stats()
+
+	if stats.MRUSize != 10 {
+		t.Errorf("Expected MRU size 10, got %d", stats.MRUSize)
+	}
+
+	if stats.Evictions != 40 {
+		t.Errorf("Expected 40 evictions, got %d", stats.Evictions)
+	}
+
+	// The newest key is always set.
+	if c.Get("49") != "value" {
+		t.Error("Expected newest key to exist")
+	}
+
+	if _, err := bicache.New(&bicache.Config{
+		MRUSize:       10,
+		NoOverflow:    true,
+		OverflowEvict: true,
+	}); err == nil {
+		t.Error("Expected error with NoOverflow and OverflowEvict")
+	}
+
+	if err := c.Reconfigure(&bicache.Config{MRUSize: 10, NoOverflow: true}); err == nil {
+		t.Error("Expected error with NoOverflow and OverflowEvict")
+	}
+}
+
+type testStore struct {
+	entries []bicache.WarmEntry
+	block   bool
+}
+
+func (ts *testStore) Save(ctx context.Context, entries []bicache.WarmEntry) error {
+	if ts.block {
+		select {}
+	}
+
+	ts.entries = entries
+	return nil
+}
+
+func TestFlushOnClose(t *testing.T) {
+	store := &testStore{}
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:      10,
+		MRUSize:      30,
+		ShardCount:   2,
+		AutoEvict:    10000,
+		Store:        store,
+		FlushOnClose: true,
+	})
+
+	c.Set("key", "value")
+	c.SetTTL("ttl", "value", 60)
+
+	c.Close()
+
+	if len(store.entries) != 2 {
+		t.Errorf("Expected 2 flushed entries, got %d", len(store.entries))
+	}
+
+	// A hung store doesn't block Close
+	// beyond the flush timeout.
+	c, _ = bicache.New(&bicache.Config{
+		MFUSize:      10,
+		MRUSize:      30,
+		ShardCount:   2,
+		AutoEvict:    10000,
+		Store:        &testStore{block: true},
+		FlushOnClose: true,
+		FlushTimeout: 50 * time.Millisecond,
+	})
+
+	start := time.Now()
+	c.Close()
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %s", d)
+	}
+}
+
+func TestRecentEvictions(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:         0,
+		MRUSize:         5,
+		ShardCount:      1,
+		AutoEvict:       60000,
+		EvictionHistory: 3,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.SetTTL("expired", "value", -1)
+
+	c.SyncEvict()
+
+	evictions := c.RecentEvictions()
+
+	if len(evictions) != 3 {
+		t.Fatalf("Expected 3 evictions, got %d", len(evictions))
+	}
+
+	// The oldest records are overwritten.
+	expected := []bicache.EvictionRecord{
+		{Key: "2", Reason: bicache.EvictReasonCapacity},
+		{Key: "3", Reason: bicache.EvictReasonCapacity},
+		{Key: "4", Reason: bicache.EvictReasonCapacity},
+	}
+
+	for i, e := range evictions {
+		if e.Key != expected[i].Key || e.Reason != expected[i].Reason || e.Time.IsZero() {
+			t.Errorf("Unexpected eviction record %+v", e)
+		}
+	}
+
+	c.SetTTL("expired2", "value", -1)
+	c.SyncEvict()
+
+	evictions = c.RecentEvictions()
+	if last := evictions[len(evictions)-1]; last.Key != "expired2" || last.Reason != bicache.EvictReasonTTL {
+		t.Errorf("Unexpected eviction record %+v", last)
+	}
+}
+
 func TestCanceledContext(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	c, _ := bicache.New(&bicache.Config{
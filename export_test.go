@@ -0,0 +1,80 @@
+package bicache
+
+import (
+	"time"
+
+	"github.com/jamiealquiza/bicache/v2/sll"
+)
+
+// Test hooks for internal state
+// used by the bicache_test package.
+
+// MFUAllocated returns whether or not any
+// shard of b has an MFU list allocated.
+func MFUAllocated(b *Bicache) bool {
+	for _, s := range b.shards {
+		s.RLock()
+		allocated := s.mfuCache != nil
+		s.RUnlock()
+
+		if allocated {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetEntryState overwrites the state of key k's
+// entry without moving its node, corrupting the
+// cache for Validate tests.
+func SetEntryState(b *Bicache, k string, state uint8) {
+	s := b.shard(k)
+
+	s.Lock()
+	if e, exists := s.cacheMap[k]; exists {
+		e.state = state
+	}
+	s.Unlock()
+}
+
+// InjectShardState replaces the contents of the shard
+// at index with entries, all placed in the MRU with the
+// given scores and TTLs. Entries are inserted in order,
+// so the last entry is at the MRU head. This allows
+// benchmarking promotions and evictions with a controlled
+// score distribution.
+func InjectShardState(b *Bicache, index int, entries []WarmEntry) {
+	s := b.shards[index]
+	now := s.clock.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.cacheMap = make(map[string]*entry, len(entries))
+	s.mfuCache = newMFU(s.mfuCap)
+	s.mruCache = sll.New()
+	s.prioritized = 0
+
+	s.ttlLock.Lock()
+	s.ttlMap = make(map[string]time.Time)
+	s.nearestExpire = noExpire
+	s.ttlLock.Unlock()
+	s.syncTTLCount()
+
+	for _, we := range entries {
+		e := &entry{node: s.mruCache.PushHead(&cacheData{k: we.Key, v: we.Value})}
+		e.node.Score = we.Score
+		s.cacheMap[we.Key] = e
+
+		if we.TTL > 0 {
+			s.setExpiration(we.Key, now.Add(we.TTL))
+		}
+	}
+}
+
+// PromoteEvict runs a promotion/eviction
+// on the shard of b at index.
+func PromoteEvict(b *Bicache, index int) bool {
+	return b.shards[index].promoteEvict()
+}
@@ -3,7 +3,14 @@
 package bicache
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"reflect"
 	"sort"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -11,12 +18,16 @@ import (
 	"github.com/jamiealquiza/fnv"
 )
 
-// KeyInfo holds a key name, state (0: MRU, 1: MFU)
-// and cache score.
+// KeyInfo holds a key name, state (0: MRU, 1: MFU),
+// cache score and priority (see SetWithPriority). TTL
+// holds the remaining TTL where populated (see
+// ExpiringWithin).
 type KeyInfo struct {
-	Key   string
-	State uint8
-	Score uint64
+	Key      string
+	State    uint8
+	Score    uint64
+	TTL      time.Duration
+	Priority int
 }
 
 // ListResults is a container that holds results from
@@ -39,6 +50,17 @@ func (lr ListResults) Swap(i, j int) {
 	lr[i], lr[j] = lr[j], lr[i]
 }
 
+// WarmEntry is a key, value, score and
+// optional remaining TTL used to seed the
+// cache with Warm. A TTL of 0 means the key
+// has no TTL.
+type WarmEntry struct {
+	Key   string
+	Value interface{}
+	Score uint64
+	TTL   time.Duration
+}
+
 // Bicache is storing a [2]interface{}
 // as the underlying sll node's value.
 // Position 0 is the node's key and position
@@ -51,250 +73,2676 @@ func (lr ListResults) Swap(i, j int) {
 // and entry in the MRU cache. If the key
 // already exists, the value is updated.
 func (b *Bicache) Set(k string, v interface{}) bool {
-	s := b.shards[b.getShard(k)]
+	if b.onOpStart != nil {
+		defer b.opEnd(b.onOpStart(OpSet, k))
+	}
+
+	return b.set(b.shard(k), k, v, setOpts{}) == nil
+}
+
+// SetBytesKey is the same as Set, but takes a []byte
+// key. The key is hashed and looked up without conversion
+// and only copied into a string when a new key is inserted.
+func (b *Bicache) SetBytesKey(k []byte, v interface{}) bool {
+	return b.set(b.shardBytes(k), "", v, setOpts{kb: k}) == nil
+}
+
+// SetWithPriority is the same as Set, but also sets
+// the priority of key k. When choosing keys to evict
+// by capacity, lower priority keys are evicted before
+// higher priority keys regardless of score or recency,
+// which break ties between keys of equal priority. Keys
+// set without a priority have a priority of 0, and a
+// plain Set of an existing key preserves its priority.
+func (b *Bicache) SetWithPriority(k string, v interface{}, p int) bool {
+	s := b.shard(k)
+
+	return b.set(s, k, v, setOpts{
+		post: func(n *entry, _ bool) {
+			s.setPriority(n, p)
+		},
+	}) == nil
+}
+
+// setOpts vary the behavior of set.
+type setOpts struct {
+	// kb, if non-nil, is the key instead of k,
+	// and is only converted to a string if a new
+	// key is inserted.
+	kb []byte
+	// ctx, if non-nil, makes a set of a new key
+	// into a full shard wait for space until ctx
+	// is done, rather than overflow.
+	ctx context.Context
+	// update, if non-nil, is called with the entry
+	// of an existing key and the new value before
+	// it's updated. The set is skipped if it
+	// returns false.
+	update func(n *entry, v interface{}) bool
+	// post, if non-nil, is called with the key's
+	// entry and whether or not the key existed
+	// before the shard is unlocked.
+	post func(n *entry, existed bool)
+}
+
+// set implements the Set variants, setting v for key
+// k in shard s as varied by o. ErrClosed is returned
+// if the cache is closed. ErrRejected is returned if
+// the key or value is rejected (e.g. by MaxValueBytes),
+// if a new key doesn't fit with NoOverflow set, or if
+// o.update skips the set. If o.ctx is done before space
+// is available, ctx.Err() is returned.
+func (b *Bicache) set(s *Shard, k string, v interface{}, o setOpts) error {
+	keyLen := len(k)
+	if o.kb != nil {
+		keyLen = len(o.kb)
+	}
+
+	if b.isClosed(s) {
+		return ErrClosed
+	}
+
+	if b.keyTooLong(s, keyLen) {
+		return ErrRejected
+	}
+
+	v, ok := b.marshalValue(v)
+	if !ok || b.tooLarge(s, v) {
+		return ErrRejected
+	}
+
+	lookup := func() (*entry, bool) {
+		if o.kb != nil {
+			n, exists := s.cacheMap[string(o.kb)]
+			return n, exists
+		}
+
+		n, exists := s.cacheMap[k]
+		return n, exists
+	}
 
 	s.Lock()
+
+	n, exists := lookup()
+	for o.ctx != nil && !exists && s.full() {
+		if err := o.ctx.Err(); err != nil {
+			s.Unlock()
+			return err
+		}
+
+		// Wait for space to be signaled,
+		// or for ctx to be done.
+		atomic.AddUint32(&s.waiting, 1)
+		space := s.space
+		s.Unlock()
+
+		select {
+		case <-space:
+		case <-o.ctx.Done():
+		}
+
+		s.Lock()
+		atomic.AddUint32(&s.waiting, ^uint32(0))
+
+		// The key may have been
+		// set while waiting.
+		n, exists = lookup()
+	}
+
 	// If the entry exists, update. If not,
 	// create at the tail of the MRU cache.
-	if n, exists := s.cacheMap[k]; !exists {
-		// Return false if we're at capacity
-		// and no overflow is set.
-		if s.noOverflow && s.mruCache.Len() >= s.mruCap {
+	if !exists {
+		// Reject the set if we're at
+		// capacity and no overflow is set.
+		if s.rejectsOverflow() && s.full() {
 			s.Unlock()
 			atomic.AddUint64(&s.counters.overflows, 1)
-			return false
+			return ErrRejected
 		}
 
-		// Create at the MRU tail.
-		s.cacheMap[k] = &entry{
-			node: s.mruCache.PushHead(&cacheData{k: k, v: v}),
+		if o.kb != nil {
+			k = string(o.kb)
 		}
+
+		n = s.insert(k, v)
 	} else {
-		n.node.Value.(*cacheData).v = v
-		if n.state == 0 {
-			s.mruCache.MoveToHead(n.node)
+		if o.update != nil && !o.update(n, v) {
+			s.Unlock()
+			return ErrRejected
 		}
+
+		n.node.Value.(*cacheData).v = v
+		s.touch(n)
+	}
+
+	if o.post != nil {
+		o.post(n, exists)
 	}
 
 	s.Unlock()
 
-	// promoteEvict on write if it's
-	// not being handled automatically.
-	if !b.autoEvict {
-		s.promoteEvict()
-	}
+	b.postSet(s, 1)
 
-	return true
+	return nil
+}
+
+// SetBlocking is the same as Set, but if k doesn't exist
+// and its shard is at capacity, SetBlocking waits for space
+// to be freed before inserting. Space is freed when keys are
+// removed from the shard (e.g. by TTL expiration or deletion)
+// or promoted out of the MRU. While sets are waiting, the next
+// eviction (the AutoEvict cycle, or the next set's eviction if
+// evictions happen at write time) also evicts a key for each
+// waiting set. ctx.Err() is returned if ctx is done before
+// space is available.
+// ErrClosed or ErrRejected are returned if the cache is
+// closed or the value is rejected (e.g. by MaxValueBytes).
+func (b *Bicache) SetBlocking(ctx context.Context, k string, v interface{}) error {
+	return b.set(b.shard(k), k, v, setOpts{ctx: ctx})
 }
 
 // SetTTL is the same as set but accepts a
 // parameter t to specify a TTL in seconds.
 func (b *Bicache) SetTTL(k string, v interface{}, t int32) bool {
-	s := b.shards[b.getShard(k)]
+	if b.onOpStart != nil {
+		defer b.opEnd(b.onOpStart(OpSetTTL, k))
+	}
 
-	s.Lock()
+	_, _, _, ok := b.setTTL(k, v, t, false)
+	return ok
+}
 
-	// Set TTL expiration
-	expiration := time.Now().Add(time.Second * time.Duration(t))
-	s.ttlMap[k] = expiration
+// SetTTLReturning is the same as SetTTL, but returns the
+// key's previous expiration and whether or not the key
+// existed. A zero prev time means the key had no prior
+// TTL. A zero time and false are also returned if the
+// set fails.
+func (b *Bicache) SetTTLReturning(k string, v interface{}, t int32) (prev time.Time, existed bool) {
+	prev, existed, _, _ = b.setTTL(k, v, t, false)
+	return prev, existed
+}
 
-	// Increment TTL counter.
-	atomic.AddUint64(&s.ttlCount, 1)
+// SetTTLExtend is the same as SetTTL, but the expiration
+// of an existing key is only updated if the new expiration
+// is later than the current one; the value is set either
+// way. Existing keys without a TTL never expire and are
+// left without one. This prevents a late write with a short
+// TTL from shortening a longer TTL set by another writer.
+// Returns whether or not the TTL was set or extended.
+func (b *Bicache) SetTTLExtend(k string, v interface{}, t int32) bool {
+	_, _, extended, _ := b.setTTL(k, v, t, true)
+	return extended
+}
 
-	// Proceed to normal Set operation.
-	// This logic is duplicated for now
-	// to skip releasing / re-acquiring a mutex.
+// setTTL sets k to v with a TTL of t seconds, returning
+// the previous expiration, whether or not k existed,
+// whether or not the TTL was set, and whether or not the
+// set was successful. If extend is true, the TTL of an
+// existing key is only set if it's later than the current
+// expiration, and existing keys without a TTL keep none.
+func (b *Bicache) setTTL(k string, v interface{}, t int32, extend bool) (time.Time, bool, bool, bool) {
+	var prev time.Time
+	var existed, setTTL bool
+
+	s := b.shard(k)
+	expiration := s.expiration(t)
+
+	err := b.set(s, k, v, setOpts{
+		post: func(_ *entry, exists bool) {
+			existed, setTTL = exists, true
+
+			if extend && exists {
+				// Only extend later
+				// expirations.
+				current, hasTTL := s.ttlMap[k]
+				prev = current
+				setTTL = hasTTL && expiration.After(current)
+			}
+
+			// Set TTL expiration.
+			if setTTL {
+				prev, _ = s.setExpiration(k, expiration)
+			}
+		},
+	})
+
+	return prev, existed, setTTL, err == nil
+}
+
+// SetTTLBatch is the same as calling SetTTL for each
+// key and value in items, all with a TTL of t seconds.
+// Keys are grouped by shard so that each shard is locked
+// once and its TTL tracking is updated once. Items that
+// are rejected (e.g. by NoOverflow or MaxValueBytes) are
+// skipped. The number of items set is returned.
+func (b *Bicache) SetTTLBatch(items map[string]interface{}, t int32) int {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+
+	var set int
+
+	for sid, positions := range b.shardBuckets(keys) {
+		if len(positions) == 0 {
+			continue
+		}
+
+		s := b.shards[sid]
+
+		if b.isClosed(s) {
+			return set
+		}
+
+		setKeys := make([]string, 0, len(positions))
+
+		s.Lock()
+
+		for _, i := range positions {
+			k := keys[i]
+
+			if b.keyTooLong(s, len(k)) {
+				continue
+			}
+
+			v, ok := b.marshalValue(items[k])
+			if !ok || b.tooLarge(s, v) {
+				continue
+			}
+
+			if n, exists := s.cacheMap[k]; !exists {
+				if s.rejectsOverflow() && s.full() {
+					atomic.AddUint64(&s.counters.overflows, 1)
+					continue
+				}
+				s.insert(k, v)
+			} else {
+				s.restore(n, v)
+			}
+
+			setKeys = append(setKeys, k)
+		}
+
+		s.setExpirations(setKeys, t)
+
+		s.Unlock()
+
+		b.postSet(s, len(setKeys))
+		set += len(setKeys)
+	}
+
+	return set
+}
+
+// SetChanged is the same as Set, but if the key exists
+// and the new value is equal to the existing value, the
+// set is skipped entirely (the key isn't moved to the
+// head of the MRU). Only values of comparable types are
+// compared; values of other types are always set. Returns
+// whether or not the value was set.
+func (b *Bicache) SetChanged(k string, v interface{}) bool {
+	return b.set(b.shard(k), k, v, setOpts{
+		update: func(n *entry, v interface{}) bool {
+			current := n.node.Value.(*cacheData).v
+
+			// Marshaled values are
+			// compared by content.
+			if b.marshal != nil {
+				cb, ok := current.([]byte)
+				return !ok || !bytes.Equal(cb, v.([]byte))
+			}
+
+			return !equal(current, v)
+		},
+	}) == nil
+}
+
+// SetIfNewer is the same as Set but accepts a version
+// parameter. The value is only stored if the key doesn't exist
+// or if version is greater than the version of the existing
+// value. Returns whether or not the value was stored.
+func (b *Bicache) SetIfNewer(k string, v interface{}, version uint64) bool {
+	return b.set(b.shard(k), k, v, setOpts{
+		// Don't clobber a newer value.
+		update: func(n *entry, _ interface{}) bool {
+			return version > n.version
+		},
+		post: func(n *entry, _ bool) {
+			n.version = version
+		},
+	}) == nil
+}
+
+// IncrTTL increments the int64 counter at key k by delta
+// and returns the new value. If k doesn't exist, it's created
+// with the value delta and a TTL of t seconds. If k exists,
+// the TTL is preserved unless Config.IncrResetTTL is set,
+// in which case the TTL is reset to t seconds. A false is
+// returned if the existing value isn't an int64 or if the
+// key can't be created due to NoOverflow.
+func (b *Bicache) IncrTTL(k string, delta int64, t int32) (int64, bool) {
+	s := b.shard(k)
+
+	if b.isClosed(s) {
+		return 0, false
+	}
+
+	if b.keyTooLong(s, len(k)) {
+		return 0, false
+	}
+
+	expiration := s.expiration(t)
+
+	s.Lock()
+
+	var val int64
 
-	// If the entry exists, update. If not,
-	// create at the tail of the MRU cache.
 	if n, exists := s.cacheMap[k]; !exists {
 		// Return false if we're at capacity
 		// and no overflow is set.
-		if s.noOverflow && s.mruCache.Len() >= s.mruCap {
+		if s.rejectsOverflow() && s.full() {
 			s.Unlock()
 			atomic.AddUint64(&s.counters.overflows, 1)
-			return false
-		}
-		// Create at the MRU tail.
-		s.cacheMap[k] = &entry{
-			node: s.mruCache.PushHead(&cacheData{k: k, v: v}),
+			return 0, false
 		}
+
+		val = delta
+
+		s.insert(k, val)
+		s.setExpiration(k, expiration)
 	} else {
-		n.node.Value.(*cacheData).v = v
-		if n.state == 0 {
-			s.mruCache.MoveToHead(n.node)
+		cd := n.node.Value.(*cacheData)
+		current, ok := cd.v.(int64)
+		// Reclaimed counters restart at 0.
+		if !ok && !n.reclaimed() {
+			s.Unlock()
+			return 0, false
 		}
-	}
 
-	// Update the nearest expire.
-	if expiration.Before(s.nearestExpire) {
-		s.nearestExpire = expiration
+		val = current + delta
+		cd.v = val
+
+		s.touch(n)
+
+		if b.incrResetTTL {
+			s.setExpiration(k, expiration)
+		}
 	}
 
 	s.Unlock()
 
-	// promoteEvict on write if it's
-	// not being handled automatically.
-	if !b.autoEvict {
-		s.promoteEvict()
-	}
+	b.postSet(s, 1)
 
-	return true
+	return val, true
 }
 
-// Get takes a key and returns the value. Every get
-// on a key increases the key score.
-func (b *Bicache) Get(k string) interface{} {
-	s := b.shards[b.getShard(k)]
+// Update atomically replaces the value of key k with
+// the result of fn, which is called with the current
+// value under the shard write lock. This allows read-
+// modify-write updates of any value type (e.g. appending
+// to an accumulator) without racing concurrent sets. The
+// key is moved to the MRU head as with Set. Update returns
+// false if the key doesn't exist, or if the result of fn
+// can't be set (e.g. it exceeds MaxValueBytes), in which
+// case the value is unchanged. fn must not call back into
+// the cache or it will deadlock.
+func (b *Bicache) Update(k string, fn func(old interface{}) interface{}) bool {
+	s := b.shard(k)
 
-	s.RLock()
+	if b.isClosed(s) {
+		return false
+	}
 
-	if n, exists := s.cacheMap[k]; exists {
-		read := n.node.Read()
-		val := read.(*cacheData).v
+	s.Lock()
 
-		s.RUnlock()
-		atomic.AddUint64(&s.counters.hits, 1)
+	n, exists := s.cacheMap[k]
+	if !exists || n.reclaimed() {
+		s.Unlock()
+		return false
+	}
 
-		return val
+	cd := n.node.Value.(*cacheData)
+
+	v, ok := b.marshalValue(fn(b.unmarshalValue(cd.v)))
+	if !ok || b.tooLarge(s, v) {
+		s.Unlock()
+		return false
 	}
 
-	s.RUnlock()
-	atomic.AddUint64(&s.counters.misses, 1)
+	cd.v = v
+	s.touch(n)
 
-	return nil
-}
+	s.Unlock()
 
-// Del deletes a key.
-func (b *Bicache) Del(k string) {
-	s := b.shards[b.getShard(k)]
+	b.postSet(s, 1)
 
-	s.Lock()
+	return true
+}
 
-	if n, exists := s.cacheMap[k]; exists {
-		delete(s.cacheMap, k)
-		delete(s.ttlMap, k)
-		switch n.state {
-		case 0:
-			s.mruCache.Remove(n.node)
-		case 1:
-			s.mfuCache.Remove(n.node)
-		}
-	}
+// Tx is a transaction over a set of keys
+// declared to Atomic. Tx methods must only
+// be called from within the Atomic function.
+type Tx struct {
+	b      *Bicache
+	shards map[string]*Shard
+	writes map[string]txWrite
+}
 
-	s.Unlock()
+// txWrite is a pending Tx set or delete. v is
+// the value passed to Set and stored is the
+// value to store (e.g. the marshaled value).
+type txWrite struct {
+	v      interface{}
+	stored interface{}
+	del    bool
 }
 
-// List returns all key names, states, and scores
-// sorted in descending order by score. Returns n
-// top restults.
-func (b *Bicache) List(n int) ListResults {
-	// Make a ListResults large enough to hold the
-	// number of cache items present in both cache tiers.
-	lr := make(ListResults, 0, b.Size)
-
-	var i int
-	for _, shard := range b.shards {
-		for k, v := range shard.cacheMap {
-			lr = append(lr, &KeyInfo{
-				Key:   k,
-				State: v.state,
-				Score: v.node.Score,
-			})
-			i++
-		}
+// Atomic runs fn with a Tx scoped to keys, holding the
+// write locks of the shards of all keys for the duration
+// so that no other operation observes a partial update.
+// All keys touched must be declared up front; Tx methods
+// ignore undeclared keys. Shards are locked in ascending
+// index order, so concurrent Atomic calls can't deadlock.
+// Sets and deletes are buffered and applied together
+// after fn returns. If fn returns an error, or NoOverflow
+// is set and the new keys don't fit in their shards, no
+// changes are applied and the error (or ErrRejected) is
+// returned. ErrClosed is returned if the cache is closed.
+// fn must not call other Bicache methods, which would
+// deadlock.
+func (b *Bicache) Atomic(keys []string, fn func(tx *Tx) error) error {
+	if atomic.LoadUint32(&b.closed) == 1 {
+		return ErrClosed
 	}
 
-	sort.Sort(lr)
-	// return the number
-	// of items requested.
-	if n < len(lr) {
-		return lr[:n]
+	tx := &Tx{
+		b:      b,
+		shards: make(map[string]*Shard, len(keys)),
+		writes: make(map[string]txWrite, len(keys)),
 	}
 
-	return lr
-}
+	var locked []*Shard
+	for i, bucket := range b.shardBuckets(keys) {
+		if len(bucket) == 0 {
+			continue
+		}
 
-// FlushMRU flushes all MRU entries.
-func (b *Bicache) FlushMRU() error {
-	// Traverse shards.
-	for _, s := range b.shards {
-		s.Lock()
+		s := b.shards[i]
+		for _, j := range bucket {
+			k := keys[j]
+			tx.shards[k] = s
 
-		// Remove cacheMap entries.
-		for k, v := range s.cacheMap {
-			if v.state == 0 {
-				delete(s.cacheMap, k)
-				delete(s.ttlMap, k)
+			if b.lazyExpiry() {
+				s.expireDue(k)
 			}
 		}
 
-		s.mruCache = sll.New()
+		locked = append(locked, s)
+	}
 
-		s.Unlock()
+	sets, err := func() (map[*Shard]int, error) {
+		for _, s := range locked {
+			s.Lock()
+		}
+
+		defer func() {
+			for _, s := range locked {
+				s.Unlock()
+			}
+		}()
+
+		if err := fn(tx); err != nil {
+			return nil, err
+		}
+
+		return tx.commit()
+	}()
+
+	for s, n := range sets {
+		b.postSet(s, n)
 	}
 
-	return nil
+	return err
 }
 
-// FlushMFU flushes all MFU entries.
-func (b *Bicache) FlushMFU() error {
-	// Traverse shards.
-	for _, s := range b.shards {
-		s.Lock()
+// Get returns the value of declared key k, reflecting
+// earlier Sets and Dels in the transaction. nil is
+// returned if k doesn't exist or wasn't declared.
+func (tx *Tx) Get(k string) interface{} {
+	s, ok := tx.shards[k]
+	if !ok {
+		return nil
+	}
 
-		// Remove cacheMap entries.
-		for k, v := range s.cacheMap {
-			if v.state == 1 {
-				delete(s.cacheMap, k)
-				delete(s.ttlMap, k)
-			}
+	if w, ok := tx.writes[k]; ok {
+		if w.del {
+			return nil
 		}
+		return w.v
+	}
 
-		s.mfuCache = sll.New()
+	if n, exists := s.cacheMap[k]; exists && !n.reclaimed() {
+		val := tx.b.read(s, n)
+		atomic.AddUint64(&s.counters.hits, 1)
 
-		s.Unlock()
+		return tx.b.unmarshalValue(val)
 	}
 
+	atomic.AddUint64(&s.counters.misses, 1)
+
 	return nil
 }
 
-// FlushAll flushes all cache entries.
-// Flush all is much faster than combining both a
-// FlushMRU and FlushMFU call.
-func (b *Bicache) FlushAll() error {
-	// Traverse and reset shard caches.
-	for _, s := range b.shards {
-		s.Lock()
-
-		// Reset cache and TTL maps and nearest expire.
-		s.cacheMap = make(map[string]*entry, s.mfuCap+s.mruCap)
-		s.ttlMap = make(map[string]time.Time)
-		s.nearestExpire = time.Now().Add(time.Second * 2147483647)
+// Set sets declared key k to v when the
+// transaction is applied. false is returned
+// if k wasn't declared or the value is rejected
+// (e.g. by MaxValueBytes).
+func (tx *Tx) Set(k string, v interface{}) bool {
+	s, ok := tx.shards[k]
+	if !ok {
+		return false
+	}
 
-		// Create new caches.
-		s.mfuCache = sll.New()
-		s.mruCache = sll.New()
+	if tx.b.keyTooLong(s, len(k)) {
+		return false
+	}
 
-		s.Unlock()
+	stored, ok := tx.b.marshalValue(v)
+	if !ok || tx.b.tooLarge(s, stored) {
+		return false
 	}
 
-	return nil
+	tx.writes[k] = txWrite{v: v, stored: stored}
+
+	return true
 }
 
-// Pause suspends normal and TTL evictions.
-// If eviction logging is enabled, bicache
-// will log that evictions are paused
-// at each interval if paused.
-func (b *Bicache) Pause() error {
-	atomic.StoreUint32(&b.paused, 1)
-	return nil
+// Del deletes declared key k when the
+// transaction is applied. Undeclared
+// keys are ignored.
+func (tx *Tx) Del(k string) {
+	if _, ok := tx.shards[k]; ok {
+		tx.writes[k] = txWrite{del: true}
+	}
 }
 
-// Resume resumes normal and TTL evictions.
-func (b *Bicache) Resume() error {
-	atomic.StoreUint32(&b.paused, 0)
-	return nil
+// commit applies the pending writes and returns
+// the number of sets per shard. If NoOverflow is
+// set and the new keys don't fit in a shard, no
+// writes are applied and ErrRejected is returned.
+// The shards of all declared keys must be locked.
+func (tx *Tx) commit() (map[*Shard]int, error) {
+	// Count the new keys inserted into each
+	// shard against the free slots, including
+	// those freed by deletes.
+	free := map[*Shard]int{}
+	for k, w := range tx.writes {
+		s := tx.shards[k]
+		if _, ok := free[s]; !ok {
+			free[s] = s.free()
+		}
+
+		n, exists := s.cacheMap[k]
+		switch {
+		case !w.del && !exists:
+			free[s]--
+		case w.del && exists && (s.mruCap == 0 || n.state == 0):
+			free[s]++
+		}
+	}
+
+	for s, n := range free {
+		if s.rejectsOverflow() && n < 0 {
+			atomic.AddUint64(&s.counters.overflows, 1)
+			return nil, ErrRejected
+		}
+	}
+
+	sets := map[*Shard]int{}
+	for k, w := range tx.writes {
+		s := tx.shards[k]
+		n, exists := s.cacheMap[k]
+
+		switch {
+		case w.del:
+			if exists {
+				s.remove(k, n)
+				s.syncTTLCount()
+			}
+		case exists:
+			s.restore(n, w.stored)
+			sets[s]++
+		default:
+			s.insert(k, w.stored)
+			sets[s]++
+		}
+	}
+
+	return sets, nil
+}
+
+// Warm bulk sets entries, seeding each key's score
+// with the entry Score. Entries with a TTL have their
+// remaining TTL honored as-is (without TTLJitter); entries
+// with a negative TTL have already expired and are skipped.
+// Entries are grouped by shard so that each shard is locked
+// once. Warm is intended for restoring a cache from a
+// snapshot; the MRU/MFU placement of warmed keys is left to
+// the next promotion/eviction. The number of entries set
+// is returned.
+func (b *Bicache) Warm(entries []WarmEntry) int {
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+
+	var warmed int
+
+	// Entry positions are bucketed by shard.
+	for sid, positions := range b.shardBuckets(keys) {
+		if len(positions) == 0 {
+			continue
+		}
+
+		s := b.shards[sid]
+
+		if b.isClosed(s) {
+			return warmed
+		}
+
+		var set int
+		now := s.clock.Now()
+
+		s.Lock()
+
+		for _, i := range positions {
+			we := &entries[i]
+
+			if we.TTL < 0 {
+				continue
+			}
+
+			if b.keyTooLong(s, len(we.Key)) {
+				continue
+			}
+
+			v, ok := b.marshalValue(we.Value)
+			if !ok || b.tooLarge(s, v) {
+				continue
+			}
+
+			n, exists := s.cacheMap[we.Key]
+			if !exists {
+				// Skip if we're at capacity
+				// and no overflow is set.
+				if s.rejectsOverflow() && s.full() {
+					atomic.AddUint64(&s.counters.overflows, 1)
+					continue
+				}
+
+				n = s.insert(we.Key, v)
+			} else {
+				n.node.Value.(*cacheData).v = v
+				s.touch(n)
+			}
+
+			atomic.StoreUint64(&n.node.Score, we.Score)
+
+			_, hasTTL := s.ttlMap[we.Key]
+
+			switch {
+			case we.TTL > 0:
+				s.setExpiration(we.Key, now.Add(we.TTL))
+			case hasTTL:
+				// A permanent entry replaces
+				// an existing TTL'd key.
+				s.deleteExpiration(we.Key)
+				s.syncTTLCount()
+			}
+
+			set++
+		}
+
+		s.Unlock()
+
+		if set > 0 {
+			b.postSet(s, set)
+		}
+
+		warmed += set
+	}
+
+	return warmed
+}
+
+// Get takes a key and returns the value. Every get
+// on a key increases the key score. If AutoEvict is
+// disabled, an expired key is evicted by the get
+// and treated as a miss.
+func (b *Bicache) Get(k string) interface{} {
+	if b.onOpStart != nil {
+		defer b.opEnd(b.onOpStart(OpGet, k))
+	}
+
+	s := b.shard(k)
+
+	if b.lazyExpiry() {
+		s.expireDue(k)
+	}
+
+	b.getLock(s)
+
+	if n, exists := s.cacheMap[k]; exists && !n.reclaimed() {
+		if b.debug {
+			b.checkEntry(s, k, n)
+		}
+
+		val := b.read(s, n)
+
+		b.getUnlock(s)
+		atomic.AddUint64(&s.counters.hits, 1)
+
+		return b.unmarshalValue(val)
+	}
+
+	b.getUnlock(s)
+	atomic.AddUint64(&s.counters.misses, 1)
+
+	return nil
+}
+
+// GetRefresh is the same as Get, but if key k has
+// a TTL, its expiration is reset to t seconds from now
+// on a hit, giving sliding expirations for keys read
+// through GetRefresh. Keys without a TTL are returned
+// without one. An expired key is evicted and treated as
+// a miss rather than refreshed. Unlike Get, GetRefresh
+// takes the shard write lock to update the expiration,
+// so it contends with other gets on the shard.
+func (b *Bicache) GetRefresh(k string, t int32) interface{} {
+	s := b.shard(k)
+
+	s.Lock()
+
+	n, exists := s.cacheMap[k]
+	if exists {
+		if ttl, hasTTL := s.ttlMap[k]; hasTTL && !s.clock.Now().Before(ttl) {
+			// Evict the expired key.
+			s.evictKeys([]string{k}, EvictReasonTTL)
+			exists = false
+		}
+	}
+
+	if !exists || n.reclaimed() {
+		s.Unlock()
+		atomic.AddUint64(&s.counters.misses, 1)
+
+		return nil
+	}
+
+	val := b.read(s, n)
+
+	if _, hasTTL := s.ttlMap[k]; hasTTL {
+		s.setExpiration(k, s.expiration(t))
+	}
+
+	s.Unlock()
+	atomic.AddUint64(&s.counters.hits, 1)
+
+	return b.unmarshalValue(val)
+}
+
+// GetBytesKey is the same as Get, but takes a []byte
+// key. The key is hashed and looked up without
+// allocating a string copy.
+func (b *Bicache) GetBytesKey(k []byte) interface{} {
+	s := b.shardBytes(k)
+
+	if b.lazyExpiry() {
+		s.expireDue(string(k))
+	}
+
+	b.getLock(s)
+
+	if n, exists := s.cacheMap[string(k)]; exists && !n.reclaimed() {
+		val := b.read(s, n)
+
+		b.getUnlock(s)
+		atomic.AddUint64(&s.counters.hits, 1)
+
+		return b.unmarshalValue(val)
+	}
+
+	b.getUnlock(s)
+	atomic.AddUint64(&s.counters.misses, 1)
+
+	return nil
+}
+
+// MultiGet takes a slice of keys and returns a slice of
+// values positionally aligned with keys. Missing keys have
+// a nil value. Keys are grouped by shard so that each shard
+// is locked once. Every get on a key increases the key score.
+func (b *Bicache) MultiGet(keys []string) []interface{} {
+	vals := make([]interface{}, len(keys))
+
+	for sid, positions := range b.shardBuckets(keys) {
+		if len(positions) == 0 {
+			continue
+		}
+
+		s := b.shards[sid]
+		var hits, misses uint64
+
+		if b.lazyExpiry() {
+			for _, i := range positions {
+				s.expireDue(keys[i])
+			}
+		}
+
+		b.getLock(s)
+
+		for _, i := range positions {
+			if n, exists := s.cacheMap[keys[i]]; exists && !n.reclaimed() {
+				vals[i] = b.read(s, n)
+				hits++
+			} else {
+				misses++
+			}
+		}
+
+		b.getUnlock(s)
+
+		atomic.AddUint64(&s.counters.hits, hits)
+		atomic.AddUint64(&s.counters.misses, misses)
+	}
+
+	if b.unmarshal != nil {
+		for i := range vals {
+			vals[i] = b.unmarshalValue(vals[i])
+		}
+	}
+
+	return vals
+}
+
+// ExistsMulti takes a slice of keys and returns a slice
+// of bools, positionally aligned with keys, reporting
+// whether or not each key exists. Keys whose TTL has
+// expired but that haven't yet been evicted are reported
+// as absent. Keys are grouped by shard so that each shard
+// is read locked once. Unlike MultiGet, key scores and
+// hit/miss counters are unchanged.
+func (b *Bicache) ExistsMulti(keys []string) []bool {
+	exists := make([]bool, len(keys))
+
+	for sid, positions := range b.shardBuckets(keys) {
+		if len(positions) == 0 {
+			continue
+		}
+
+		s := b.shards[sid]
+
+		s.RLock()
+
+		now := s.clock.Now()
+
+		for _, i := range positions {
+			n, ok := s.cacheMap[keys[i]]
+			if !ok || n.reclaimed() {
+				continue
+			}
+
+			ttl, hasTTL := s.ttlMap[keys[i]]
+			exists[i] = !hasTTL || now.Before(ttl)
+		}
+
+		s.RUnlock()
+	}
+
+	return exists
+}
+
+// StaleValue is a value returned by GetMultiStale.
+// Stale is true if the key's TTL has expired but
+// the key hasn't yet been evicted.
+type StaleValue struct {
+	Value interface{}
+	Stale bool
+}
+
+// GetMultiStale takes a slice of keys and returns a map
+// of the keys found to their values. Keys whose TTL has
+// expired but that haven't yet been evicted are included
+// and marked stale, allowing callers to serve stale values
+// while refreshing the stale subset in bulk. Keys are grouped
+// by shard so that each shard is locked once. Every get on
+// a key increases the key score.
+func (b *Bicache) GetMultiStale(keys []string) map[string]StaleValue {
+	vals := make(map[string]StaleValue, len(keys))
+
+	for sid, positions := range b.shardBuckets(keys) {
+		if len(positions) == 0 {
+			continue
+		}
+
+		s := b.shards[sid]
+		var hits, misses uint64
+
+		b.getLock(s)
+
+		now := s.clock.Now()
+
+		for _, i := range positions {
+			k := keys[i]
+			if n, exists := s.cacheMap[k]; exists && !n.reclaimed() {
+				ttl, hasTTL := s.ttlMap[k]
+				vals[k] = StaleValue{
+					Value: b.read(s, n),
+					Stale: hasTTL && !now.Before(ttl),
+				}
+				hits++
+			} else {
+				misses++
+			}
+		}
+
+		b.getUnlock(s)
+
+		atomic.AddUint64(&s.counters.hits, hits)
+		atomic.AddUint64(&s.counters.misses, misses)
+	}
+
+	if b.unmarshal != nil {
+		for k, v := range vals {
+			v.Value = b.unmarshalValue(v.Value)
+			vals[k] = v
+		}
+	}
+
+	return vals
+}
+
+// GetOrSetFunc returns the value for key k if it exists and
+// hasn't expired. Otherwise, f is called and its result is set
+// as the value for k and returned. A key that has expired but
+// hasn't yet been evicted is treated as absent and replaced.
+// f is called while the shard is locked, ensuring that it's
+// called at most once for concurrent calls on the same missing
+// key; f must not call back into the cache or it will deadlock.
+// If the result can't be set (e.g. due to NoOverflow), it's
+// returned but not stored.
+func (b *Bicache) GetOrSetFunc(k string, f func() interface{}) interface{} {
+	s := b.shard(k)
+
+	s.Lock()
+
+	n, exists := s.cacheMap[k]
+	if exists {
+		if ttl, hasTTL := s.ttlMap[k]; hasTTL && !s.clock.Now().Before(ttl) {
+			// Evict the expired key.
+			s.evictKeys([]string{k}, EvictReasonTTL)
+			exists = false
+		} else if !n.reclaimed() {
+			val := b.read(s, n)
+
+			s.Unlock()
+			atomic.AddUint64(&s.counters.hits, 1)
+
+			return b.unmarshalValue(val)
+		}
+	}
+
+	atomic.AddUint64(&s.counters.misses, 1)
+
+	v := f()
+
+	if b.isClosed(s) {
+		s.Unlock()
+		return v
+	}
+
+	stored, ok := b.marshalValue(v)
+	if !ok || b.tooLarge(s, stored) || b.keyTooLong(s, len(k)) {
+		s.Unlock()
+		return v
+	}
+
+	if exists {
+		s.restore(n, stored)
+	} else {
+		if s.rejectsOverflow() && s.full() {
+			s.Unlock()
+			atomic.AddUint64(&s.counters.overflows, 1)
+			return v
+		}
+
+		s.insert(k, stored)
+	}
+
+	s.Unlock()
+
+	b.postSet(s, 1)
+
+	return v
+}
+
+// GetOrSetTTL returns the value for key k and true if
+// it exists and hasn't expired. Otherwise, v is set with
+// a TTL of t seconds and returned with false. A key that
+// has expired but hasn't yet been evicted is treated as
+// absent and replaced. If v can't be set (e.g. due to
+// NoOverflow), it's returned but not stored.
+func (b *Bicache) GetOrSetTTL(k string, v interface{}, t int32) (interface{}, bool) {
+	s := b.shard(k)
+
+	s.Lock()
+
+	n, exists := s.cacheMap[k]
+	if exists {
+		if ttl, hasTTL := s.ttlMap[k]; hasTTL && !s.clock.Now().Before(ttl) {
+			// Evict the expired key.
+			s.evictKeys([]string{k}, EvictReasonTTL)
+			exists = false
+		} else if !n.reclaimed() {
+			val := b.read(s, n)
+
+			s.Unlock()
+			atomic.AddUint64(&s.counters.hits, 1)
+
+			return b.unmarshalValue(val), true
+		}
+	}
+
+	atomic.AddUint64(&s.counters.misses, 1)
+
+	if b.isClosed(s) {
+		s.Unlock()
+		return v, false
+	}
+
+	stored, ok := b.marshalValue(v)
+	if !ok || b.tooLarge(s, stored) || b.keyTooLong(s, len(k)) {
+		s.Unlock()
+		return v, false
+	}
+
+	if exists {
+		s.restore(n, stored)
+	} else {
+		if s.rejectsOverflow() && s.full() {
+			s.Unlock()
+			atomic.AddUint64(&s.counters.overflows, 1)
+			return v, false
+		}
+
+		s.insert(k, stored)
+	}
+
+	s.setExpiration(k, s.expiration(t))
+
+	s.Unlock()
+
+	b.postSet(s, 1)
+
+	return v, false
+}
+
+// GetOrLoad returns the value for key k if it exists
+// and hasn't expired. Otherwise, loader is called and
+// the value it returns is set for k and returned. If
+// loader returns an error, nothing is set and the error
+// is returned. Loads are tracked per key so that loader
+// is called at most once for concurrent calls on the same
+// missing key; the other calls wait for it and return its
+// result. loader is called without the shard locked, so
+// it may call back into the cache. If the value can't be
+// set (e.g. due to NoOverflow), it's returned but not stored.
+func (b *Bicache) GetOrLoad(k string, loader func() (interface{}, error)) (interface{}, error) {
+	return b.getOrLoad(k, func() (interface{}, time.Duration, error) {
+		v, err := loader()
+		return v, 0, err
+	})
+}
+
+// GetOrLoadTTL is the same as GetOrLoad, but loader
+// also returns a TTL for the value, which is set along
+// with the value under the same shard lock. There's no
+// window where the loaded value is cached without its
+// TTL. A TTL <= 0 sets the value without a TTL.
+func (b *Bicache) GetOrLoadTTL(k string, loader func() (interface{}, time.Duration, error)) (interface{}, error) {
+	return b.getOrLoad(k, loader)
+}
+
+// loadCall is an in-flight getOrLoad loader
+// call. done is closed once v and err are set.
+type loadCall struct {
+	done chan struct{}
+	v    interface{}
+	err  error
+}
+
+// getOrLoad implements GetOrLoad and GetOrLoadTTL.
+func (b *Bicache) getOrLoad(k string, loader func() (interface{}, time.Duration, error)) (interface{}, error) {
+	s := b.shard(k)
+
+	s.Lock()
+
+	n, exists := s.cacheMap[k]
+	if exists {
+		if ttl, hasTTL := s.ttlMap[k]; hasTTL && !s.clock.Now().Before(ttl) {
+			// Evict the expired key.
+			s.evictKeys([]string{k}, EvictReasonTTL)
+		} else if !n.reclaimed() {
+			val := b.read(s, n)
+
+			s.Unlock()
+			atomic.AddUint64(&s.counters.hits, 1)
+
+			return b.unmarshalValue(val), nil
+		}
+	}
+
+	atomic.AddUint64(&s.counters.misses, 1)
+
+	// Wait for an in-flight load of k.
+	if c, loading := s.loads[k]; loading {
+		s.Unlock()
+		<-c.done
+
+		return c.v, c.err
+	}
+
+	c := &loadCall{done: make(chan struct{})}
+	if s.loads == nil {
+		s.loads = make(map[string]*loadCall)
+	}
+	s.loads[k] = c
+
+	s.Unlock()
+
+	// Release waiters even if loader panics.
+	defer func() {
+		s.Lock()
+		delete(s.loads, k)
+		s.Unlock()
+
+		close(c.done)
+	}()
+
+	var ttl time.Duration
+	c.v, ttl, c.err = loader()
+	if c.err != nil {
+		c.v = nil
+		return nil, c.err
+	}
+
+	b.set(s, k, c.v, setOpts{
+		post: func(_ *entry, _ bool) {
+			if ttl > 0 {
+				s.setExpiration(k, s.expireAfter(ttl))
+			}
+		},
+	})
+
+	return c.v, nil
+}
+
+// Promote moves key k from the MRU to the MFU
+// regardless of score. If the MFU is full, the lowest
+// score MFU key is demoted to the MRU to make room.
+// Promote returns false if the key doesn't exist or
+// if the cache has no MFU.
+func (b *Bicache) Promote(k string) bool {
+	s := b.shard(k)
+
+	s.Lock()
+	defer s.Unlock()
+
+	n, exists := s.cacheMap[k]
+	if !exists || s.mfuCap == 0 {
+		return false
+	}
+
+	// Already in the MFU.
+	if n.state == 1 {
+		return true
+	}
+
+	// Demote the coldest MFU key
+	// if the MFU is full. MFU-only caches
+	// never reach here since all keys
+	// are MFU keys.
+	if s.mfuCache.Len() >= s.mfuCap {
+		for _, node := range s.mfuCache.LowScores(1) {
+			s.demote(node)
+		}
+	}
+
+	s.promote(n.node)
+
+	return true
+}
+
+// PromoteWorkingSet moves the highest score MRU keys
+// in each shard into the free MFU slots, regardless
+// of score, e.g. to promote a known hot set after a
+// warm-up phase rather than waiting for keys to be
+// promoted by reads. MFU keys are never displaced.
+// The number of keys promoted is returned.
+func (b *Bicache) PromoteWorkingSet() int {
+	var promoted int
+
+	for _, s := range b.shards {
+		s.Lock()
+		promoted += s.promoteWorkingSet()
+		s.Unlock()
+	}
+
+	return promoted
+}
+
+// Demote moves key k from the MFU to the
+// head of the MRU. Demote returns false if the
+// key isn't in the MFU or if the cache has no MRU.
+func (b *Bicache) Demote(k string) bool {
+	s := b.shard(k)
+
+	s.Lock()
+	defer s.Unlock()
+
+	n, exists := s.cacheMap[k]
+	if !exists || n.state != 1 || s.mruCap == 0 {
+		return false
+	}
+
+	s.demote(n.node)
+
+	return true
+}
+
+// SetMeta attaches application metadata to
+// key k. Metadata is preserved across value
+// updates and promotions/demotions and is
+// removed with the key. SetMeta is a no-op
+// if the key doesn't exist.
+func (b *Bicache) SetMeta(k string, meta interface{}) {
+	s := b.shard(k)
+
+	s.Lock()
+
+	if n, exists := s.cacheMap[k]; exists {
+		n.meta = meta
+	}
+
+	s.Unlock()
+}
+
+// GetMeta returns the metadata for key k and
+// whether or not the key exists. Unlike Get,
+// GetMeta doesn't increase the key score.
+func (b *Bicache) GetMeta(k string) (interface{}, bool) {
+	s := b.shard(k)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if n, exists := s.cacheMap[k]; exists {
+		return n.meta, true
+	}
+
+	return nil, false
+}
+
+// State returns the state of key k (0: MRU, 1: MFU)
+// and whether or not the key exists. Unlike Get,
+// State doesn't increase the key score.
+func (b *Bicache) State(k string) (uint8, bool) {
+	s := b.shard(k)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if n, exists := s.cacheMap[k]; exists {
+		return n.state, true
+	}
+
+	return 0, false
+}
+
+// Del deletes a key.
+func (b *Bicache) Del(k string) {
+	if b.onOpStart != nil {
+		defer b.opEnd(b.onOpStart(OpDel, k))
+	}
+
+	s := b.shard(k)
+
+	s.Lock()
+
+	if n, exists := s.cacheMap[k]; exists {
+		if b.debug {
+			b.checkEntry(s, k, n)
+		}
+
+		s.remove(k, n)
+		s.syncTTLCount()
+	}
+
+	s.Unlock()
+}
+
+// DelReturn deletes key k and returns its value
+// and whether or not it existed, under a single
+// shard lock. Like Del, the OnEvict hook isn't
+// called for deleted keys.
+func (b *Bicache) DelReturn(k string) (interface{}, bool) {
+	s := b.shard(k)
+
+	s.Lock()
+
+	n, exists := s.cacheMap[k]
+	if !exists {
+		s.Unlock()
+		return nil, false
+	}
+
+	val, live := n.value(), !n.reclaimed()
+
+	s.remove(k, n)
+	s.syncTTLCount()
+
+	s.Unlock()
+
+	return b.unmarshalValue(val), live
+}
+
+// EvictLRU evicts up to n keys across all shards,
+// distributed proportionally to each shard's key count.
+// Keys are evicted from the MRU tail first, then from the
+// MFU in order of least recent promotion if the MRU is
+// exhausted. The number of keys evicted is returned.
+func (b *Bicache) EvictLRU(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	quotas := b.shardQuotas(n)
+
+	var evicted int
+
+	for i, s := range b.shards {
+		if quotas[i] == 0 {
+			continue
+		}
+
+		s.Lock()
+
+		// The MFU is only evicted from once
+		// the MRU is exhausted, not for keys
+		// that CanEvict vetoed.
+		fromMRU := quotas[i]
+		if mruLen := int(s.mruCache.Len()); fromMRU > mruLen {
+			fromMRU = mruLen
+		}
+		evicted += s.evictFromMRUTail(fromMRU)
+
+		fromMFU := quotas[i] - fromMRU
+		if mfuLen := int(s.mfuLen()); fromMFU > mfuLen {
+			fromMFU = mfuLen
+		}
+		s.evictFromMFUHead(fromMFU)
+
+		s.Unlock()
+
+		evicted += fromMFU
+	}
+
+	return evicted
+}
+
+// shardQuotas divides n keys across shards in
+// proportion to each shard's key count. If n
+// exceeds the number of keys, every key is
+// included.
+func (b *Bicache) shardQuotas(n int) []int {
+	// Get each shard's key count
+	// to determine its share.
+	lens := make([]int, len(b.shards))
+	var total int
+
+	for i, s := range b.shards {
+		s.RLock()
+		lens[i] = len(s.cacheMap)
+		s.RUnlock()
+		total += lens[i]
+	}
+
+	// Proportional share per shard.
+	quotas := make([]int, len(b.shards))
+
+	if total == 0 {
+		return quotas
+	}
+
+	if n > total {
+		n = total
+	}
+
+	var assigned int
+
+	for i, l := range lens {
+		quotas[i] = n * l / total
+		assigned += quotas[i]
+	}
+
+	// Distribute any rounding remainder
+	// to shards with keys left over.
+	for i := 0; assigned < n && i < len(lens); i++ {
+		if lens[i] > quotas[i] {
+			quotas[i]++
+			assigned++
+		}
+	}
+
+	return quotas
+}
+
+// Reclaim drops the values of up to n keys across
+// all shards, distributed proportionally to each
+// shard's key count, to free memory under pressure
+// ahead of capacity evictions. Values are reclaimed
+// from the MRU tail first, then from the lowest score
+// MFU keys. Reclaimed keys retain their score, tier,
+// TTL and metadata, but gets of a reclaimed key are
+// misses (as if it had been evicted) until it's set
+// again, e.g. by a reload with GetOrLoad. Reclaimed
+// keys are excluded from Dump and Snapshot, and
+// OnEvict is called with a nil value if they're
+// evicted. The number of values reclaimed is returned.
+func (b *Bicache) Reclaim(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	var reclaimed int
+
+	for i, q := range b.shardQuotas(n) {
+		if q == 0 {
+			continue
+		}
+
+		s := b.shards[i]
+
+		s.Lock()
+		reclaimed += s.reclaim(q)
+		s.Unlock()
+	}
+
+	return reclaimed
+}
+
+// EvictLFU evicts up to n keys with the lowest scores
+// across all shards, regardless of cache tier. Lower
+// priority keys are evicted first (see SetWithPriority).
+// The number of keys evicted is returned.
+func (b *Bicache) EvictLFU(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	type candidate struct {
+		k        string
+		shard    int
+		score    uint64
+		priority int
+	}
+
+	var candidates []candidate
+
+	// Gather the n lowest scores from
+	// each tier of each shard. The global
+	// n lowest scores are a subset of these.
+	for i, s := range b.shards {
+		s.RLock()
+		for _, ll := range []*sll.Sll{s.mruCache, s.mfuCache} {
+			if ll == nil {
+				continue
+			}
+
+			for _, node := range s.lowScores(ll, n) {
+				candidates = append(candidates, candidate{
+					k:        node.Value.(*cacheData).k,
+					shard:    i,
+					score:    atomic.LoadUint64(&node.Score),
+					priority: s.priority(node),
+				})
+			}
+		}
+		s.RUnlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+
+		return candidates[i].score < candidates[j].score
+	})
+
+	if n < len(candidates) {
+		candidates = candidates[:n]
+	}
+
+	// Bucket by shard.
+	toEvict := make(map[int][]string)
+	for _, c := range candidates {
+		toEvict[c.shard] = append(toEvict[c.shard], c.k)
+	}
+
+	var evicted int
+	for i, keys := range toEvict {
+		s := b.shards[i]
+		s.Lock()
+		evicted += s.evictKeys(keys, EvictReasonCapacity)
+		s.Unlock()
+	}
+
+	return evicted
+}
+
+// List returns the top n key names, states, scores
+// and priorities sorted in descending order by score.
+// No keys are returned if n <= 0, regardless of the
+// number of keys cached, and every key is returned if n
+// exceeds the number cached. If Config.MaxListResults
+// is set, n is capped to it and keys beyond the cap
+// aren't returned. The top n
+// keys of each shard are selected with a heap and then
+// merged, so sorting and allocations scale with n rather
+// than the number of keys in the cache.
+func (b *Bicache) List(n int) ListResults {
+	if b.maxListResults > 0 && n > b.maxListResults {
+		n = b.maxListResults
+	}
+
+	if n <= 0 {
+		return ListResults{}
+	}
+
+	var lr ListResults
+
+	for _, s := range b.shards {
+		s.RLock()
+		for _, ki := range s.highScores(n) {
+			ki := ki
+			lr = append(lr, &ki)
+		}
+		s.RUnlock()
+	}
+
+	sort.Sort(lr)
+	// return the number
+	// of items requested.
+	if n < len(lr) {
+		return lr[:n]
+	}
+
+	return lr
+}
+
+// HotKeys returns the top n keys by score across
+// all shards. Like List, the top n keys of each
+// shard's MFU and MRU are selected with a heap and
+// then merged, but HotKeys isn't subject to
+// Config.MaxListResults. Each shard is read locked
+// while its lists are traversed, and released before
+// moving to the next shard. This is useful for
+// identifying individual keys that dominate a shard.
+func (b *Bicache) HotKeys(n int) []KeyInfo {
+	if n <= 0 {
+		return nil
+	}
+
+	var hot []KeyInfo
+
+	for _, s := range b.shards {
+		s.RLock()
+		hot = append(hot, s.highScores(n)...)
+		s.RUnlock()
+	}
+
+	sort.Slice(hot, func(i, j int) bool {
+		return hot[i].Score > hot[j].Score
+	})
+
+	if n < len(hot) {
+		hot = hot[:n]
+	}
+
+	return hot
+}
+
+// RandomKey returns a randomly selected key and true, or
+// false if the cache is empty. A random shard is selected,
+// followed by a random key within it; empty shards are
+// skipped. Keys are selected by iterating the shard's map
+// to a random offset, so the distribution is only
+// approximately uniform, particularly across shards with
+// differing key counts. The key's score is unchanged.
+func (b *Bicache) RandomKey() (string, bool) {
+	// The first shard's random source
+	// selects the starting shard.
+	start := int(b.shards[0].int63n(int64(len(b.shards))))
+
+	for i := range b.shards {
+		s := b.shards[(start+i)%len(b.shards)]
+
+		s.RLock()
+		k, ok := s.randomKey()
+		s.RUnlock()
+
+		if ok {
+			return k, true
+		}
+	}
+
+	return "", false
+}
+
+// KeysOfType returns the keys, in sorted order, of all
+// values whose dynamic type is the same as the type of
+// sample. If Unmarshal is set, values are unmarshaled
+// to be compared. Each shard is read locked while its
+// values are inspected. This inspects every value and
+// is intended for debugging caches holding values of
+// mixed types.
+func (b *Bicache) KeysOfType(sample interface{}) []string {
+	t := reflect.TypeOf(sample)
+
+	var keys []string
+	var stored map[string]interface{}
+
+	for _, s := range b.shards {
+		s.RLock()
+
+		if b.unmarshal == nil {
+			for k, n := range s.cacheMap {
+				if !n.reclaimed() && reflect.TypeOf(n.node.Value.(*cacheData).v) == t {
+					keys = append(keys, k)
+				}
+			}
+
+			s.RUnlock()
+			continue
+		}
+
+		// Copy the stored values so that they're
+		// unmarshaled without holding the lock.
+		stored = make(map[string]interface{}, len(s.cacheMap))
+		for k, n := range s.cacheMap {
+			if !n.reclaimed() {
+				stored[k] = n.node.Value.(*cacheData).v
+			}
+		}
+
+		s.RUnlock()
+
+		for k, v := range stored {
+			if reflect.TypeOf(b.unmarshalValue(v)) == t {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ExpiringWithin returns all keys that are set
+// to expire within duration d, sorted by
+// remaining TTL in ascending order.
+func (b *Bicache) ExpiringWithin(d time.Duration) []KeyInfo {
+	keys := []KeyInfo{}
+
+	for _, s := range b.shards {
+		s.RLock()
+
+		now := s.clock.Now()
+		deadline := now.Add(d)
+
+		for k, ttl := range s.ttlMap {
+			if ttl.After(deadline) {
+				continue
+			}
+
+			if n, exists := s.cacheMap[k]; exists {
+				keys = append(keys, KeyInfo{
+					Key:      k,
+					State:    n.state,
+					Score:    atomic.LoadUint64(&n.node.Score),
+					TTL:      ttl.Sub(now),
+					Priority: n.priority(),
+				})
+			}
+		}
+
+		s.RUnlock()
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].TTL < keys[j].TTL
+	})
+
+	return keys
+}
+
+// Dump returns a copy of all keys
+// and values in the cache. This is
+// expensive for large caches.
+func (b *Bicache) Dump() map[string]interface{} {
+	dump := make(map[string]interface{})
+
+	for _, s := range b.shards {
+		s.RLock()
+		for k, n := range s.cacheMap {
+			if !n.reclaimed() {
+				dump[k] = n.node.Value.(*cacheData).v
+			}
+		}
+		s.RUnlock()
+	}
+
+	if b.unmarshal != nil {
+		for k, v := range dump {
+			dump[k] = b.unmarshalValue(v)
+		}
+	}
+
+	return dump
+}
+
+// DumpN returns a copy of the top n
+// keys and values by score. An empty
+// map is returned if n <= 0.
+func (b *Bicache) DumpN(n int) map[string]interface{} {
+	if n <= 0 {
+		return map[string]interface{}{}
+	}
+
+	type scored struct {
+		k     string
+		v     interface{}
+		score uint64
+	}
+
+	var top []scored
+
+	// Merge the top n of each shard tier.
+	for _, s := range b.shards {
+		s.RLock()
+		for _, ll := range []*sll.Sll{s.mfuCache, s.mruCache} {
+			if ll == nil {
+				continue
+			}
+
+			for _, node := range highScores(ll, n) {
+				cd := node.Value.(*cacheData)
+				top = append(top, scored{
+					k:     cd.k,
+					v:     cd.v,
+					score: atomic.LoadUint64(&node.Score),
+				})
+			}
+		}
+		s.RUnlock()
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].score > top[j].score
+	})
+
+	if n < len(top) {
+		top = top[:n]
+	}
+
+	dump := make(map[string]interface{}, len(top))
+	for _, e := range top {
+		dump[e.k] = b.unmarshalValue(e.v)
+	}
+
+	return dump
+}
+
+// highScores returns up to n of the highest
+// score nodes in ll with values that haven't
+// been reclaimed. The list's shard must be
+// locked.
+func highScores(ll *sll.Sll, n int) []*sll.Node {
+	for k := n; ; k *= 2 {
+		nodes := ll.HighScores(k)
+
+		live := make([]*sll.Node, 0, len(nodes))
+		for _, node := range nodes {
+			if _, ok := node.Value.(*cacheData).v.(reclaimedValue); !ok {
+				live = append(live, node)
+			}
+		}
+
+		if len(live) >= n || len(nodes) < k {
+			return live
+		}
+	}
+}
+
+// Snapshot returns a point-in-time copy of all
+// cache entries as a []WarmEntry, which can be passed
+// to Warm to restore the cache. All shards are read
+// locked for the duration of the copy so that the
+// result is consistent across shards; sets are blocked
+// while the snapshot is taken. The snapshot is a copy,
+// not a live view: it holds a WarmEntry for every key
+// and isn't affected by subsequent mutations. Values are
+// copied by assignment, so reference type values share
+// their underlying data with the cache.
+func (b *Bicache) Snapshot() []WarmEntry {
+	for _, s := range b.shards {
+		s.RLock()
+	}
+
+	var size int
+	for _, s := range b.shards {
+		size += len(s.cacheMap)
+	}
+
+	snapshot := make([]WarmEntry, 0, size)
+	now := b.clock.Now()
+
+	for _, s := range b.shards {
+		for k, n := range s.cacheMap {
+			if n.reclaimed() {
+				continue
+			}
+
+			we := WarmEntry{
+				Key:   k,
+				Value: n.node.Value.(*cacheData).v,
+				Score: atomic.LoadUint64(&n.node.Score),
+			}
+
+			if ttl, hasTTL := s.ttlMap[k]; hasTTL {
+				we.TTL = ttl.Sub(now)
+				// An expired but not yet evicted key
+				// is captured with a negative TTL
+				// and skipped by Warm.
+				if we.TTL == 0 {
+					we.TTL = -1
+				}
+			}
+
+			snapshot = append(snapshot, we)
+		}
+	}
+
+	for _, s := range b.shards {
+		s.RUnlock()
+	}
+
+	if b.unmarshal != nil {
+		for i := range snapshot {
+			snapshot[i].Value = b.unmarshalValue(snapshot[i].Value)
+		}
+	}
+
+	return snapshot
+}
+
+// SnapshotTop writes a gob encoded snapshot of the
+// top n keys by score to w, which can be loaded with
+// Restore. This is intended for warm starting a new
+// cache with just the hot working set. Each shard's
+// top n keys are selected while the shard is read
+// locked, so the snapshot is consistent per shard but
+// not across shards. TTLs are captured as the remaining
+// TTL at snapshot time. Value types other than basic
+// types must be registered with gob.Register.
+func (b *Bicache) SnapshotTop(w io.Writer, n int) error {
+	var top []WarmEntry
+
+	if n > 0 {
+		for _, s := range b.shards {
+			s.RLock()
+
+			now := s.clock.Now()
+			for _, ll := range []*sll.Sll{s.mfuCache, s.mruCache} {
+				if ll == nil {
+					continue
+				}
+
+				for _, node := range ll.HighScores(n) {
+					cd := node.Value.(*cacheData)
+					if _, ok := cd.v.(reclaimedValue); ok {
+						continue
+					}
+
+					we := WarmEntry{
+						Key:   cd.k,
+						Value: cd.v,
+						Score: atomic.LoadUint64(&node.Score),
+					}
+
+					if ttl, hasTTL := s.ttlMap[cd.k]; hasTTL {
+						// Skip expired keys.
+						if we.TTL = ttl.Sub(now); we.TTL <= 0 {
+							continue
+						}
+					}
+
+					top = append(top, we)
+				}
+			}
+
+			s.RUnlock()
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Score > top[j].Score
+	})
+
+	if n < len(top) {
+		top = top[:n]
+	}
+
+	if b.unmarshal != nil {
+		for i := range top {
+			top[i].Value = b.unmarshalValue(top[i].Value)
+		}
+	}
+
+	return gob.NewEncoder(w).Encode(top)
+}
+
+// Restore loads a snapshot written by SnapshotTop
+// from r into the cache using Warm. The number of
+// keys restored is returned.
+func (b *Bicache) Restore(r io.Reader) (int, error) {
+	var entries []WarmEntry
+
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, err
+	}
+
+	return b.Warm(entries), nil
+}
+
+// RecentEvictions returns the most recent
+// evictions, oldest first, up to the configured
+// Config.EvictionHistory size. Nil is returned
+// if the eviction history isn't enabled.
+func (b *Bicache) RecentEvictions() []EvictionRecord {
+	if b.history == nil {
+		return nil
+	}
+
+	return b.history.list()
+}
+
+// FlushMRU flushes all MRU entries.
+func (b *Bicache) FlushMRU() error {
+	// Traverse shards.
+	for _, s := range b.shards {
+		s.Lock()
+
+		// Remove cacheMap entries.
+		for k, v := range s.cacheMap {
+			if v.state == 0 {
+				delete(s.cacheMap, k)
+				s.deleteExpiration(k)
+				if v.priority() != 0 {
+					s.prioritized--
+				}
+			}
+		}
+
+		s.mruCache = sll.New()
+		s.syncTTLCount()
+		s.signalSpace()
+
+		s.Unlock()
+	}
+
+	return nil
+}
+
+// FlushMFU flushes all MFU entries.
+func (b *Bicache) FlushMFU() error {
+	// Traverse shards.
+	for _, s := range b.shards {
+		s.Lock()
+
+		// Remove cacheMap entries.
+		for k, v := range s.cacheMap {
+			if v.state == 1 {
+				delete(s.cacheMap, k)
+				s.deleteExpiration(k)
+				if v.priority() != 0 {
+					s.prioritized--
+				}
+			}
+		}
+
+		s.mfuCache = newMFU(s.mfuCap)
+		s.syncTTLCount()
+		s.signalSpace()
+
+		s.Unlock()
+	}
+
+	return nil
+}
+
+// FlushAll flushes all cache entries.
+// Flush all is much faster than combining both a
+// FlushMRU and FlushMFU call.
+func (b *Bicache) FlushAll() error {
+	// Traverse and reset shard caches.
+	for _, s := range b.shards {
+		s.Lock()
+
+		// Reset cache and TTL maps and nearest expire.
+		s.cacheMap = make(map[string]*entry, s.initCap)
+		s.ttlLock.Lock()
+		s.ttlMap = make(map[string]time.Time)
+		s.nearestExpire = noExpire
+		s.ttlLock.Unlock()
+
+		// Create new caches.
+		s.mfuCache = newMFU(s.mfuCap)
+		s.mruCache = sll.New()
+		s.prioritized = 0
+		s.syncTTLCount()
+		s.signalSpace()
+
+		s.Unlock()
+	}
+
+	return nil
+}
+
+// FlushExcept flushes all cache entries except
+// those with keys in keep, which retain their values,
+// scores and TTLs. The keep list is bucketed by shard
+// and each shard is locked once. Returns the number
+// of entries flushed.
+func (b *Bicache) FlushExcept(keep []string) int {
+	var flushed int
+
+	for sid, positions := range b.shardBuckets(keep) {
+		s := b.shards[sid]
+
+		keepSet := make(map[string]struct{}, len(positions))
+		for _, i := range positions {
+			keepSet[keep[i]] = struct{}{}
+		}
+
+		s.Lock()
+
+		for k, e := range s.cacheMap {
+			if _, ok := keepSet[k]; !ok {
+				s.remove(k, e)
+				flushed++
+			}
+		}
+
+		s.syncTTLCount()
+
+		s.Unlock()
+	}
+
+	return flushed
+}
+
+// Copy returns a new, independent *Bicache with the
+// same configuration and a copy of the keys, values,
+// scores, cache tiers, TTLs and metadata of b, e.g. for
+// forking the cache state for what-if analysis. Each
+// shard is read locked while it's copied, so the copy is
+// consistent per shard but not across shards. Values and
+// metadata are copied by reference. The copy starts with
+// zeroed stats, has its own background eviction task
+// (if configured), and isn't paused. Since the copy shares
+// the configured Store, FlushOnClose should be considered
+// before closing both. An error is returned if the copy
+// can't be created with the configuration of b.
+func (b *Bicache) Copy() (*Bicache, error) {
+	cp, err := b.CloneEmpty()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, s := range b.shards {
+		ns := cp.shards[i]
+
+		s.RLock()
+		ns.Lock()
+		s.copyInto(ns)
+		ns.Unlock()
+		s.RUnlock()
+	}
+
+	return cp, nil
+}
+
+// Swap atomically replaces the contents of the cache
+// with entries. The new contents are built without
+// holding any shard locks, then all shards are locked
+// and their contents swapped at once, so that readers
+// see either the old or new contents but never a mix.
+// Replaced keys aren't passed to OnEvict, and existing
+// TTLs and priorities are dropped, including those of
+// keys present in entries. Entries beyond a
+// shard's capacity are skipped if NoOverflow or
+// OverflowEvict are set, otherwise they're evicted
+// as with any set. Swap returns the number of
+// entries set.
+func (b *Bicache) Swap(entries map[string]interface{}) int {
+	if b.isClosed(b.shards[0]) {
+		return 0
+	}
+
+	// Build the new keys of each shard in
+	// a list. Lists are placed into a cache
+	// tier once the shards are locked.
+	maps := make([]map[string]*entry, len(b.shards))
+	lists := make([]*sll.Sll, len(b.shards))
+
+	for i, s := range b.shards {
+		maps[i] = make(map[string]*entry, s.initCap)
+		lists[i] = sll.New()
+	}
+
+	for k, v := range entries {
+		sid := 0
+		if b.single == nil {
+			sid = b.getShard(k)
+		}
+
+		s := b.shards[sid]
+
+		if b.keyTooLong(s, len(k)) {
+			continue
+		}
+
+		v, ok := b.marshalValue(v)
+		if !ok || b.tooLarge(s, v) {
+			continue
+		}
+
+		maps[sid][k] = s.pushNewEntry(lists[sid], k, v)
+	}
+
+	for _, s := range b.shards {
+		s.Lock()
+	}
+
+	sets := make([]int, len(b.shards))
+	var swapped int
+
+	for i, s := range b.shards {
+		s.swapContents(maps[i], lists[i])
+
+		sets[i] = len(s.cacheMap)
+		swapped += sets[i]
+	}
+
+	for _, s := range b.shards {
+		s.Unlock()
+	}
+
+	for i, s := range b.shards {
+		b.postSet(s, sets[i])
+	}
+
+	return swapped
+}
+
+// pushNewEntry returns a new entry for key k and
+// value v with its node pushed to the head of ll,
+// a list that isn't yet part of the shard. Since
+// newEntry only uses the entry pool, the shard
+// doesn't need to be locked.
+func (s *Shard) pushNewEntry(ll *sll.Sll, k string, v interface{}) *entry {
+	e := s.newEntry(k, v)
+	ll.PushHeadNode(e.node)
+
+	return e
+}
+
+// swapContents replaces the shard's contents with the
+// keys in cacheMap, whose nodes are linked in ll. ll
+// becomes the MRU, or the MFU of an MFU-only shard. Keys
+// beyond the shard capacity are dropped if overflow
+// isn't evicted later. The shard must be locked.
+func (s *Shard) swapContents(cacheMap map[string]*entry, ll *sll.Sll) {
+	capacity, state := s.mruCap, uint8(0)
+	if capacity == 0 {
+		capacity, state = s.mfuCap, 1
+	}
+
+	if s.rejectsOverflow() || s.overflowEvict {
+		for ll.Len() > capacity {
+			node := ll.Head()
+			k := node.Value.(*cacheData).k
+			e := cacheMap[k]
+
+			ll.Remove(node)
+			delete(cacheMap, k)
+			s.release(e)
+
+			atomic.AddUint64(&s.counters.overflows, 1)
+		}
+	}
+
+	for _, e := range cacheMap {
+		e.state = state
+	}
+
+	s.cacheMap = cacheMap
+	if state == 1 {
+		s.mfuCache, s.mruCache = ll, sll.New()
+	} else {
+		s.mfuCache, s.mruCache = newMFU(s.mfuCap), ll
+	}
+	s.prioritized = 0
+
+	s.ttlLock.Lock()
+	s.ttlMap = make(map[string]time.Time)
+	s.nearestExpire = noExpire
+	s.ttlLock.Unlock()
+
+	s.syncTTLCount()
+	s.signalSpace()
+}
+
+// SetNoOverflow enables or disables NoOverflow at
+// runtime, e.g. to allow overflow during a backfill
+// so that sets never fail and restore strict capacity
+// afterward. Sets already in progress may observe
+// the previous setting. An error is returned if
+// enabling NoOverflow on a cache configured with
+// OverflowEvict.
+func (b *Bicache) SetNoOverflow(enabled bool) error {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	if enabled && b.config.OverflowEvict {
+		return errors.New("NoOverflow and OverflowEvict are mutually exclusive")
+	}
+
+	for _, s := range b.shards {
+		s.setNoOverflow(enabled)
+	}
+
+	b.config.NoOverflow = enabled
+
+	return nil
+}
+
+// Pause suspends normal and TTL evictions.
+// If eviction logging is enabled, bicache
+// will log that evictions are paused
+// at each interval if paused.
+func (b *Bicache) Pause() error {
+	atomic.StoreUint32(&b.paused, 1)
+	return nil
+}
+
+// Resume resumes normal and TTL evictions.
+func (b *Bicache) Resume() error {
+	atomic.StoreUint32(&b.paused, 0)
+	return nil
+}
+
+// postSet records n keys set in shard s and handles
+// promotions and evictions after a set if they're not
+// being handled automatically (LRU and FIFO mode
+// evictions are always handled here). Otherwise, the OnOverCapacity
+// hook is called if configured and the shard is over
+// capacity.
+func (b *Bicache) postSet(s *Shard, n int) {
+	atomic.AddUint64(&s.counters.sets, uint64(n))
+
+	// LRU and FIFO modes always
+	// evict overflow at write time.
+	if b.mode.mruOnly() {
+		s.Lock()
+		s.evictLRUOverflow()
+		s.Unlock()
+		s.makeRoom()
+		return
+	}
+
+	// promoteEvict on write if it's
+	// not being handled automatically.
+	if !b.autoEvicting() {
+		s.promoteEvict()
+		s.makeRoom()
+		return
+	}
+
+	if b.onOverCapacity != nil {
+		s.RLock()
+		over := s.overCapacity()
+		s.RUnlock()
+
+		if over > 0 {
+			b.hooks.call("OnOverCapacity", func() { b.onOverCapacity(s.index, over) })
+		}
+	}
+}
+
+// rlock read locks shard s, recording the
+// time spent waiting on the lock if lock wait
+// stats are enabled.
+func (b *Bicache) rlock(s *Shard) {
+	if b.lockWait == nil {
+		s.RLock()
+		return
+	}
+
+	start := time.Now()
+	s.RLock()
+	b.addLockWait(time.Since(start))
+}
+
+// getLock locks shard s for a get. A write lock
+// is taken if PromoteOnGet is set, otherwise a read
+// lock. Lock wait times are recorded if lock wait
+// stats are enabled.
+func (b *Bicache) getLock(s *Shard) {
+	if !b.promoteOnGet {
+		b.rlock(s)
+		return
+	}
+
+	if b.lockWait == nil {
+		s.Lock()
+		return
+	}
+
+	start := time.Now()
+	s.Lock()
+	b.addLockWait(time.Since(start))
+}
+
+// addLockWait records a lock wait time of d.
+func (b *Bicache) addLockWait(d time.Duration) {
+	b.lockWaitLock.Lock()
+	b.lockWait.AddTime(d)
+	b.lockWaitLock.Unlock()
+}
+
+// getUnlock unlocks shard s
+// locked with getLock.
+func (b *Bicache) getUnlock(s *Shard) {
+	if b.promoteOnGet {
+		s.Unlock()
+		return
+	}
+
+	s.RUnlock()
+}
+
+// read returns the stored value for entry n,
+// incrementing its score (except in ModeStrictLRU
+// and ModeFIFO).
+// If PromoteOnGet is set, MRU entries are also moved
+// to the MRU head. The shard must be locked with
+// getLock.
+func (b *Bicache) read(s *Shard, n *entry) interface{} {
+	var val interface{}
+	if !b.mode.scored() {
+		val = n.node.Value.(*cacheData).v
+	} else {
+		val = n.node.Read().(*cacheData).v
+	}
+
+	if b.promoteOnGet && n.state == 0 {
+		s.mruCache.MoveToHead(n.node)
+	}
+
+	return val
+}
+
+// opEnd calls the OnOpEnd hook, if
+// configured, with the token returned
+// by the OnOpStart hook.
+func (b *Bicache) opEnd(token interface{}) {
+	if b.onOpEnd != nil {
+		b.onOpEnd(token)
+	}
+}
+
+// isClosed returns whether or not the
+// *Bicache has been closed. If so, a rejected
+// set is counted for shard s.
+func (b *Bicache) isClosed(s *Shard) bool {
+	if atomic.LoadUint32(&b.closed) == 1 {
+		atomic.AddUint64(&s.counters.closed, 1)
+		return true
+	}
+
+	return false
+}
+
+// keyTooLong returns whether or not a key of n
+// bytes exceeds the configured MaxKeyBytes. If so,
+// a rejected set is counted for shard s.
+func (b *Bicache) keyTooLong(s *Shard, n int) bool {
+	if b.maxKeyBytes > 0 && n > b.maxKeyBytes {
+		atomic.AddUint64(&s.counters.tooLong, 1)
+		return true
+	}
+
+	return false
+}
+
+// tooLarge returns whether or not value v
+// exceeds the configured MaxValueBytes. If so,
+// a rejected set is counted for shard s.
+func (b *Bicache) tooLarge(s *Shard, v interface{}) bool {
+	if b.maxValueBytes <= 0 {
+		return false
+	}
+
+	if valueSize(v, b.sizer) > b.maxValueBytes {
+		atomic.AddUint64(&s.counters.tooLarge, 1)
+		return true
+	}
+
+	return false
+}
+
+// marshalValue returns v serialized with the
+// configured Marshal func, or v as-is if unset
+// (copied if CopyOnSet is set). A false is
+// returned if v can't be marshaled.
+func (b *Bicache) marshalValue(v interface{}) (interface{}, bool) {
+	if b.marshal == nil {
+		if b.copyValue != nil {
+			return b.copyValue(v), true
+		}
+		return v, true
+	}
+
+	data, err := b.marshal(v)
+	if err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// unmarshalValue returns the stored value v
+// deserialized with the configured Unmarshal func,
+// or v as-is if unset. Stored values that aren't
+// []byte (e.g. IncrTTL counters) are returned
+// as-is. A nil is returned if v can't be unmarshaled.
+func (b *Bicache) unmarshalValue(v interface{}) interface{} {
+	if b.unmarshal == nil {
+		return v
+	}
+
+	data, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+
+	val, err := b.unmarshal(data)
+	if err != nil {
+		return nil
+	}
+
+	return val
+}
+
+// valueSize returns the size of v in bytes
+// using sizer if non-nil. Otherwise, []byte
+// and string lengths are used. Values that
+// can't be sized return 0.
+func valueSize(v interface{}, sizer func(interface{}) int) int {
+	if sizer != nil {
+		return sizer(v)
+	}
+
+	switch t := v.(type) {
+	case []byte:
+		return len(t)
+	case string:
+		return len(t)
+	}
+
+	return 0
+}
+
+// copyBytes returns a copy of v if it's
+// a []byte. Values of all other types are
+// returned as-is.
+func copyBytes(v interface{}) interface{} {
+	if t, ok := v.([]byte); ok && t != nil {
+		c := make([]byte, len(t))
+		copy(c, t)
+		return c
+	}
+
+	return v
+}
+
+// equal returns whether or not a and b are
+// equal. Values of different or non-comparable
+// types are never equal.
+func equal(a, b interface{}) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb {
+		return false
+	}
+
+	// Both nil.
+	if ta == nil {
+		return true
+	}
+
+	if !ta.Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
+// shardBuckets groups the positions of keys
+// by shard ID. Buckets are sized assuming an
+// even distribution of keys.
+func (b *Bicache) shardBuckets(keys []string) [][]int {
+	bucketSize := len(keys)/int(b.ShardCount) + 1
+	buckets := make([][]int, b.ShardCount)
+
+	for i, k := range keys {
+		sid := 0
+		if b.single == nil {
+			sid = b.getShard(k)
+		}
+
+		if buckets[sid] == nil {
+			buckets[sid] = make([]int, 0, bucketSize)
+		}
+
+		buckets[sid] = append(buckets[sid], i)
+	}
+
+	return buckets
+}
+
+// ShardIndex returns the index of
+// the shard that key k is stored in.
+func (b *Bicache) ShardIndex(k string) int {
+	if b.single != nil {
+		return 0
+	}
+
+	return b.getShard(k)
+}
+
+// KeyForShard returns a key made up of prefix
+// and a numeric suffix that's stored in the
+// shard at index shard. This allows placing keys
+// on specific shards, e.g. in tests. An empty
+// string is returned if shard is out of range.
+func (b *Bicache) KeyForShard(prefix string, shard int) string {
+	if shard < 0 || shard >= int(b.ShardCount) {
+		return ""
+	}
+
+	for i := 0; ; i++ {
+		k := prefix + strconv.Itoa(i)
+		if b.ShardIndex(k) == shard {
+			return k
+		}
+	}
+}
+
+// shard returns the shard for key k. Single
+// shard caches skip the hash-routing.
+func (b *Bicache) shard(k string) *Shard {
+	if b.single != nil {
+		return b.single
+	}
+
+	return b.shards[b.getShard(k)]
+}
+
+// shardBytes is the same as shard,
+// but for []byte keys.
+func (b *Bicache) shardBytes(k []byte) *Shard {
+	if b.single != nil {
+		return b.single
+	}
+
+	return b.shards[int(hash32Bytes(k))&int(b.ShardCount-1)]
+}
+
+// hash32Bytes returns a 32 bit FNV-1 hash of k,
+// identical to fnv.Hash32 for the equivalent
+// string but without requiring a conversion.
+func hash32Bytes(k []byte) uint32 {
+	var h uint32 = 0x811c9dc5
+	for _, c := range k {
+		h *= 0x1000193
+		h ^= uint32(c)
+	}
+
+	return h
 }
 
 // getShard returns the shard index
@@ -1,11 +1,16 @@
 package bicache_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -37,6 +42,135 @@ func BenchmarkGet(b *testing.B) {
 	}
 }
 
+func BenchmarkGetSingleShard(b *testing.B) {
+	benchmarkGetShards(b, 1)
+}
+
+func BenchmarkGetTwoShards(b *testing.B) {
+	benchmarkGetShards(b, 2)
+}
+
+// benchmarkGetShards benchmarks Get on a small
+// cache with the specified shard count. Single
+// shard caches skip key hash-routing.
+func benchmarkGetShards(b *testing.B, shards int) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    1024,
+		ShardCount: shards,
+		AutoEvict:  30000,
+	})
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.Set(keys[i], "my value")
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkGetModeLRU(b *testing.B) {
+	benchmarkGetMode(b, bicache.ModeLRU)
+}
+
+func BenchmarkGetModeStrictLRU(b *testing.B) {
+	benchmarkGetMode(b, bicache.ModeStrictLRU)
+}
+
+// benchmarkGetMode benchmarks parallel
+// Gets of a small set of hot keys on a
+// single shard in the specified mode.
+func benchmarkGetMode(b *testing.B, mode bicache.Mode) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    1024,
+		ShardCount: 1,
+		AutoEvict:  30000,
+		Mode:       mode,
+	})
+
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.Set(keys[i], "my value")
+	}
+
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.Get(keys[i%len(keys)])
+		}
+	})
+}
+
+func BenchmarkGetStringKey(b *testing.B) {
+	benchmarkGetKeyType(b, false)
+}
+
+func BenchmarkGetBytesKey(b *testing.B) {
+	benchmarkGetKeyType(b, true)
+}
+
+// benchmarkGetKeyType benchmarks Get with keys
+// that arrive as []byte, either converting them
+// to a string or using GetBytesKey. Keys are longer
+// than 32 bytes, so that the string conversion
+// can't use a stack buffer.
+func benchmarkGetKeyType(b *testing.B, bytesKey bool) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    1024,
+		ShardCount: 16,
+		AutoEvict:  30000,
+	})
+
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("namespace:object:some-longer-network-key-%d", i))
+		c.SetBytesKey(keys[i], "my value")
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if bytesKey {
+			c.GetBytesKey(keys[i%len(keys)])
+		} else {
+			c.Get(string(keys[i%len(keys)]))
+		}
+	}
+}
+
+func BenchmarkMultiGet(b *testing.B) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10000,
+		MRUSize:    600000,
+		ShardCount: 1024,
+		AutoEvict:  30000,
+	})
+
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.Set(keys[i], "my value")
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.MultiGet(keys)
+	}
+}
+
 func BenchmarkSet(b *testing.B) {
 	b.StopTimer()
 
@@ -59,6 +193,192 @@ func BenchmarkSet(b *testing.B) {
 	}
 }
 
+func BenchmarkSetEvictModeLRU(b *testing.B) {
+	benchmarkSetEvict(b, &bicache.Config{
+		MRUSize:    1024,
+		ShardCount: 1,
+		Mode:       bicache.ModeLRU,
+	})
+}
+
+func BenchmarkSetEvictMFUSizeZero(b *testing.B) {
+	benchmarkSetEvict(b, &bicache.Config{
+		MRUSize:    1024,
+		ShardCount: 1,
+	})
+}
+
+// BenchmarkSetEvictPrioritized benchmarks evicting
+// Sets on a cache holding a key with a priority,
+// where victims are selected by priority.
+func BenchmarkSetEvictPrioritized(b *testing.B) {
+	benchmarkSetEvict(b, &bicache.Config{
+		MRUSize:    1024,
+		ShardCount: 1,
+		Mode:       bicache.ModeLRU,
+	}, "p")
+}
+
+// benchmarkSetEvict benchmarks Set on a full
+// cache where each Set triggers an eviction.
+// Any prioritized keys are set with a priority
+// of 1 first.
+func benchmarkSetEvict(b *testing.B, c *bicache.Config, prioritized ...string) {
+	b.StopTimer()
+
+	cache, _ := bicache.New(c)
+
+	for _, k := range prioritized {
+		cache.SetWithPriority(k, "my value", 1)
+	}
+
+	keys := make([]string, b.N+1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, k := range keys[:1024] {
+		cache.Set(k, "my value")
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Set(keys[i+1024], "my value")
+	}
+}
+
+// BenchmarkSetDelChurn benchmarks a Set and
+// Del of a new key per iteration on a cache
+// holding a steady number of keys.
+func BenchmarkSetDelChurn(b *testing.B) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10000,
+		MRUSize:    600000,
+		ShardCount: 1024,
+		AutoEvict:  30000,
+	})
+
+	keys := make([]string, b.N+1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, k := range keys[:1024] {
+		c.Set(k, "my value")
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		c.Set(keys[i+1024], "my value")
+		c.Del(keys[i])
+	}
+}
+
+// BenchmarkPromoteEvict benchmarks a single shard
+// promotion/eviction by MRU overflow size and
+// MRU score distribution.
+func BenchmarkPromoteEvict(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+
+	dists := []struct {
+		name  string
+		score func() uint64
+	}{
+		{"Cold", func() uint64 { return 0 }},
+		{"Uniform", func() uint64 { return uint64(rng.Intn(100)) }},
+		{"Skewed", func() uint64 { return uint64(rng.ExpFloat64() * 10) }},
+	}
+
+	for _, overflow := range []int{10, 100, 1000} {
+		for _, dist := range dists {
+			name := fmt.Sprintf("Overflow%d/%s", overflow, dist.name)
+			b.Run(name, func(b *testing.B) {
+				c, _ := bicache.New(&bicache.Config{
+					MFUSize:    100,
+					MRUSize:    1000,
+					ShardCount: 1,
+					AutoEvict:  60000,
+				})
+
+				entries := make([]bicache.WarmEntry, 1000+overflow)
+				for i := range entries {
+					entries[i] = bicache.WarmEntry{
+						Key:   strconv.Itoa(i),
+						Value: "my value",
+						Score: dist.score(),
+					}
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					bicache.InjectShardState(c, 0, entries)
+					b.StartTimer()
+
+					bicache.PromoteEvict(c, 0)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkGetWithSetTTL benchmarks Get while
+// TTL'd keys are concurrently set and expired.
+func BenchmarkGetWithSetTTL(b *testing.B) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    100000,
+		ShardCount: 4,
+		AutoEvict:  30000,
+	})
+
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.SetTTL(keys[i], "my value", 3600)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// Continuously set TTLs and run
+	// TTL evictions in the background.
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			c.SetTTL(keys[i%len(keys)], "my value", 3600)
+			if i%100 == 0 {
+				c.SetTTL("expired", "my value", -1)
+				c.SyncEvict()
+			}
+		}
+	}()
+
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			c.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	wg.Wait()
+}
+
 func BenchmarkSetTTL(b *testing.B) {
 	b.StopTimer()
 
@@ -81,6 +401,36 @@ func BenchmarkSetTTL(b *testing.B) {
 	}
 }
 
+// BenchmarkSetTTLBatch benchmarks SetTTLBatch in
+// batches of 10000 keys (~10 keys per shard),
+// reporting time per key for comparison with
+// BenchmarkSetTTL.
+func BenchmarkSetTTLBatch(b *testing.B) {
+	b.StopTimer()
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10000,
+		MRUSize:    600000,
+		ShardCount: 1024,
+		AutoEvict:  30000,
+	})
+
+	batchSize := 10000
+
+	var batches []map[string]interface{}
+	for i := 0; i < b.N; i++ {
+		if i%batchSize == 0 {
+			batches = append(batches, make(map[string]interface{}, batchSize))
+		}
+		batches[len(batches)-1][strconv.Itoa(i)] = "my value"
+	}
+
+	b.StartTimer()
+	for _, batch := range batches {
+		c.SetTTLBatch(batch, 3600)
+	}
+}
+
 func BenchmarkDel(b *testing.B) {
 	b.StopTimer()
 
@@ -123,90 +473,2065 @@ func BenchmarkList(b *testing.B) {
 		keys[i] = k
 	}
 
-	for i := 0; i < b.N/2; i++ {
-		c.Set(keys[i], "my value")
+	for i := 0; i < b.N/2; i++ {
+		c.Set(keys[i], "my value")
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.List(b.N / 2)
+	}
+}
+
+// Tests
+
+func TestSetGet(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	ok := c.Set("key", "value")
+	if !ok {
+		t.Error("Set failed")
+	}
+
+	if c.Get("key") != "value" {
+		t.Error("Get failed")
+	}
+
+	// Ensure that updates work.
+	ok = c.Set("key", "value2")
+	if !ok {
+		t.Error("Update failed")
+	}
+
+	if c.Get("key") != "value2" {
+		t.Error("Update failed")
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:       10,
+		MRUSize:       30,
+		ShardCount:    2,
+		AutoEvict:     10000,
+		MaxValueBytes: 4,
+	})
+
+	if !c.Set("small", []byte("1234")) {
+		t.Error("Set failed")
+	}
+
+	if c.Set("large", "12345") {
+		t.Error("Expected set of oversized value to fail")
+	}
+
+	// Values that can't be sized are admitted.
+	if !c.Set("int", 123456) {
+		t.Error("Set failed")
+	}
+
+	if stats := c.Stats(); stats.TooLarge != 1 {
+		t.Errorf("Expected 1 too large, got %d", stats.TooLarge)
+	}
+
+	c, _ = bicache.New(&bicache.Config{
+		MFUSize:       10,
+		MRUSize:       30,
+		ShardCount:    2,
+		AutoEvict:     10000,
+		MaxValueBytes: 4,
+		Sizer: func(v interface{}) int {
+			return 8
+		},
+	})
+
+	if c.Set("int", 1) {
+		t.Error("Expected set of oversized value to fail")
+	}
+}
+
+func TestMaxKeyBytes(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:     10,
+		MRUSize:     30,
+		ShardCount:  2,
+		AutoEvict:   10000,
+		MaxKeyBytes: 4,
+	})
+
+	if !c.Set("1234", "value") {
+		t.Error("Set failed")
+	}
+
+	if c.Set("12345", "value") {
+		t.Error("Expected set of oversized key to fail")
+	}
+
+	if c.SetTTL("12345", "value", 30) {
+		t.Error("Expected set of oversized key to fail")
+	}
+
+	if c.SetBytesKey([]byte("12345"), "value") {
+		t.Error("Expected set of oversized key to fail")
+	}
+
+	stats := c.Stats()
+
+	if stats.TooLong != 3 {
+		t.Errorf("Expected 3 too long, got %d", stats.TooLong)
+	}
+
+	if stats.Rejections != 3 {
+		t.Errorf("Expected 3 rejections, got %d", stats.Rejections)
+	}
+
+	if stats.MRUSize != 1 {
+		t.Errorf("Expected MRU size 1, got %d", stats.MRUSize)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type item struct {
+		Name  string
+		Count int
+	}
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:       10,
+		MRUSize:       30,
+		ShardCount:    2,
+		AutoEvict:     10000,
+		MaxValueBytes: 32,
+		Marshal: func(v interface{}) ([]byte, error) {
+			return json.Marshal(v)
+		},
+		Unmarshal: func(b []byte) (interface{}, error) {
+			var i item
+			err := json.Unmarshal(b, &i)
+			return i, err
+		},
+	})
+
+	if !c.Set("key", item{Name: "name", Count: 1}) {
+		t.Fatal("Set failed")
+	}
+
+	if v := c.Get("key"); v != (item{Name: "name", Count: 1}) {
+		t.Errorf("Unexpected value %v", v)
+	}
+
+	// The marshaled size is checked against MaxValueBytes.
+	if c.Set("large", item{Name: "a name that's too long"}) {
+		t.Error("Expected set of oversized value to fail")
+	}
+
+	// Unchanged values are compared in their marshaled form.
+	if c.SetChanged("key", item{Name: "name", Count: 1}) {
+		t.Error("Expected unchanged set to be skipped")
+	}
+
+	if _, err := bicache.New(&bicache.Config{
+		MRUSize: 30,
+		Marshal: json.Marshal,
+	}); err == nil {
+		t.Error("Expected error with Marshal but no Unmarshal")
+	}
+}
+
+func TestCopyOnSet(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+		CopyOnSet:  true,
+	})
+
+	v := []byte("value")
+	c.Set("key", v)
+	v[0] = 'X'
+
+	if got := c.Get("key").([]byte); string(got) != "value" {
+		t.Errorf("Expected value, got %s", got)
+	}
+
+	// A custom CopyFunc handles other types.
+	type item struct{ Name string }
+
+	c, _ = bicache.New(&bicache.Config{
+		MRUSize:   30,
+		CopyOnSet: true,
+		CopyFunc: func(v interface{}) interface{} {
+			if i, ok := v.(*item); ok {
+				c := *i
+				return &c
+			}
+			return v
+		},
+	})
+
+	i := &item{Name: "name"}
+	c.Set("key", i)
+	i.Name = "changed"
+
+	if got := c.Get("key").(*item); got.Name != "name" {
+		t.Errorf("Expected name, got %s", got.Name)
+	}
+}
+
+func TestBytesKey(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 8,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 20; i++ {
+		k := []byte(strconv.Itoa(i))
+		if !c.SetBytesKey(k, i) {
+			t.Fatal("Set failed")
+		}
+	}
+
+	// Byte keys route to the same
+	// shards as their string keys.
+	for i := 0; i < 20; i++ {
+		if c.Get(strconv.Itoa(i)) != i {
+			t.Errorf("Expected value %d for key %d", i, i)
+		}
+		if c.GetBytesKey([]byte(strconv.Itoa(i))) != i {
+			t.Errorf("Expected value %d for key %d", i, i)
+		}
+	}
+
+	if c.GetBytesKey([]byte("missing")) != nil {
+		t.Error("Expected nil value")
+	}
+}
+
+func TestPromoteOnGet(t *testing.T) {
+	// Every read path updates recency
+	// with PromoteOnGet.
+	reads := map[string]func(c *bicache.Bicache, k string){
+		"Get": func(c *bicache.Bicache, k string) { c.Get(k) },
+		"GetOrSetFunc": func(c *bicache.Bicache, k string) {
+			c.GetOrSetFunc(k, func() interface{} { return "value" })
+		},
+		"GetOrSetTTL": func(c *bicache.Bicache, k string) { c.GetOrSetTTL(k, "value", 60) },
+		"GetOrLoad": func(c *bicache.Bicache, k string) {
+			c.GetOrLoad(k, func() (interface{}, error) { return "value", nil })
+		},
+	}
+
+	for name, read := range reads {
+		for _, promoteOnGet := range []bool{false, true} {
+			c, _ := bicache.New(&bicache.Config{
+				MRUSize:      5,
+				ShardCount:   1,
+				PromoteOnGet: promoteOnGet,
+			})
+
+			for i := 0; i < 5; i++ {
+				c.Set(strconv.Itoa(i), "value")
+			}
+
+			// Read the LRU key, then
+			// overflow the MRU by one.
+			read(c, "0")
+			c.Set("5", "value")
+
+			// Without PromoteOnGet, recency is
+			// only updated by sets.
+			evicted := "0"
+			if promoteOnGet {
+				evicted = "1"
+			}
+
+			if c.Get(evicted) != nil {
+				t.Errorf("Expected key %s to be evicted by %s with PromoteOnGet: %v", evicted, name, promoteOnGet)
+			}
+		}
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	keys := []string{"3", "nil", "7", "0"}
+	vals := c.MultiGet(keys)
+
+	expected := []interface{}{3, nil, 7, 0}
+	for i, v := range vals {
+		if v != expected[i] {
+			t.Errorf("Expected value %v at position %d, got %v", expected[i], i, v)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("Expected 3 hits and 1 miss, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	r := c.ReadOnly()
+
+	c.Set("key", "value")
+
+	if r.Get("key") != "value" {
+		t.Error("Expected value through the read only view")
+	}
+
+	if list := r.List(1); len(list) != 1 || list[0].Score != 1 {
+		t.Error("Expected read through the view to be scored")
+	}
+
+	// Mutating methods aren't
+	// reachable through the view.
+	type setter interface {
+		Set(string, interface{}) bool
+	}
+
+	if _, ok := r.(setter); ok {
+		t.Error("Expected Set not to be exposed")
+	}
+
+	if _, ok := r.(*bicache.Bicache); ok {
+		t.Error("Expected *Bicache not to be recoverable")
+	}
+}
+
+func TestExistsMulti(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	c.SetTTL("expired", "value", -1)
+
+	keys := []string{"3", "nil", "7", "expired", "0"}
+	exists := c.ExistsMulti(keys)
+
+	expected := []bool{true, false, true, false, true}
+	for i, e := range exists {
+		if e != expected[i] {
+			t.Errorf("Expected %t for key %s, got %t", expected[i], keys[i], e)
+		}
+	}
+
+	// Probes don't affect
+	// scores or counters.
+	stats := c.Stats()
+	if stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("Expected 0 hits and misses, got %d and %d", stats.Hits, stats.Misses)
+	}
+
+	for _, k := range c.List(20) {
+		if k.Score != 0 {
+			t.Errorf(`Expected key "%s" score 0, got %d`, k.Key, k.Score)
+		}
+	}
+}
+
+func TestGetMultiStale(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	c.Set("fresh", 1)
+	c.SetTTL("live", 2, 60)
+	c.SetTTL("expired", 3, -1)
+
+	vals := c.GetMultiStale([]string{"fresh", "live", "expired", "nil"})
+
+	if len(vals) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(vals))
+	}
+
+	expected := map[string]bicache.StaleValue{
+		"fresh":   {Value: 1},
+		"live":    {Value: 2},
+		"expired": {Value: 3, Stale: true},
+	}
+
+	for k, v := range expected {
+		if vals[k] != v {
+			t.Errorf("Expected %v for key %s, got %v", v, k, vals[k])
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("Expected 3 hits and 1 miss, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    80,
+		ShardCount: 8,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 8; i++ {
+		k := c.KeyForShard("key", i)
+		if !strings.HasPrefix(k, "key") {
+			t.Errorf("Unexpected key %s", k)
+		}
+
+		if sid := c.ShardIndex(k); sid != i {
+			t.Errorf("Expected key %s in shard %d, got %d", k, i, sid)
+		}
+	}
+
+	if k := c.KeyForShard("key", 8); k != "" {
+		t.Errorf("Expected empty key for out of range shard, got %s", k)
+	}
+}
+
+func TestOpHooks(t *testing.T) {
+	var ops []string
+	var ended []interface{}
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+		OnOpStart: func(op, key string) interface{} {
+			ops = append(ops, op+":"+key)
+			return len(ops)
+		},
+		OnOpEnd: func(token interface{}) {
+			ended = append(ended, token)
+		},
+	})
+
+	c.Set("a", "value")
+	c.SetTTL("b", "value", 60)
+	c.Get("a")
+	c.Del("b")
+
+	expected := []string{"set:a", "setttl:b", "get:a", "del:b"}
+
+	if len(ops) != len(expected) || len(ended) != len(expected) {
+		t.Fatalf("Expected %d started and ended ops, got %d and %d",
+			len(expected), len(ops), len(ended))
+	}
+
+	for i := range expected {
+		if ops[i] != expected[i] {
+			t.Errorf("Expected op %s, got %s", expected[i], ops[i])
+		}
+
+		if ended[i] != i+1 {
+			t.Errorf("Expected token %d, got %v", i+1, ended[i])
+		}
+	}
+}
+
+func TestSetWithPriority(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    4,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	// p is the least recently set
+	// key but has a higher priority.
+	c.SetWithPriority("p", "value", 1)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		c.Set(k, "value")
+	}
+
+	c.SyncEvict()
+
+	if c.Get("p") == nil {
+		t.Error(`Expected key "p" to exist`)
+	}
+
+	if c.Get("a") != nil {
+		t.Error(`Expected key "a" to be evicted`)
+	}
+
+	for _, k := range c.List(10) {
+		if k.Key == "p" && k.Priority != 1 {
+			t.Errorf(`Expected key "p" priority 1, got %d`, k.Priority)
+		}
+	}
+
+	// p has the lowest score of the
+	// remaining keys but is still kept.
+	for _, k := range []string{"b", "c", "d"} {
+		c.Get(k)
+		c.Get(k)
+	}
+
+	if n := c.EvictLFU(1); n != 1 {
+		t.Errorf("Expected 1 eviction, got %d", n)
+	}
+
+	if c.Get("p") == nil {
+		t.Error(`Expected key "p" to exist`)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	c.Del("p")
+
+	// The entry released by p is reused
+	// without its priority.
+	c.Set("e", "value")
+
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  1000,
+	})
+
+	ok := c.SetTTL("key", "value", 3)
+	if !ok {
+		t.Error("Set failed")
+	}
+
+	if c.Get("key") != "value" {
+		t.Error("Get failed")
+	}
+
+	log.Printf("Sleeping for 4 seconds to allow evictions")
+	time.Sleep(4 * time.Second)
+
+	if c.Get("key") != nil {
+		t.Error("Key TTL expiration failed")
+	}
+}
+
+func TestSetBlocking(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    2,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	ctx := context.Background()
+
+	c.SetBlocking(ctx, "1", "value")
+	c.SetBlocking(ctx, "2", "value")
+
+	// Updates to existing keys don't block.
+	if err := c.SetBlocking(ctx, "2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A full shard times out.
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.SetBlocking(timeout, "3", "value"); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	// Freeing space unblocks the set.
+	errs := make(chan error)
+	go func() {
+		errs <- c.SetBlocking(ctx, "3", "value")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	c.Del("1")
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for blocked set")
+	}
+
+	if c.Get("3") != "value" {
+		t.Error("Expected key 3 to be set")
+	}
+
+	// An eviction cycle makes room
+	// for a set waiting on a full shard.
+	go func() {
+		errs <- c.SetBlocking(ctx, "4", "value")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	c.SyncEvict()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for blocked set")
+	}
+
+	if c.Get("4") != "value" {
+		t.Error("Expected key 4 to be set")
+	}
+
+	if n := c.Stats().MRUSize; n != 2 {
+		t.Errorf("Expected MRU size 2, got %d", n)
+	}
+
+	// In an MFU-only cache, more waiting sets
+	// than keys evict and count every key once.
+	var evicted uint64
+	c, _ = bicache.New(&bicache.Config{
+		MFUSize:    2,
+		ShardCount: 1,
+		AutoEvict:  60000,
+		OnEvict: func(k string, v interface{}) {
+			atomic.AddUint64(&evicted, 1)
+		},
+	})
+
+	c.Set("1", "value")
+	c.Set("2", "value")
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer waitCancel()
+
+	for _, k := range []string{"a", "b", "c"} {
+		go func(k string) {
+			errs <- c.SetBlocking(waitCtx, k, "value")
+		}(k)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	c.SyncEvict()
+
+	if n := c.Stats().Evictions; n != 2 || n != atomic.LoadUint64(&evicted) {
+		t.Errorf("Expected 2 evictions, got %d (%d evicted)", n, atomic.LoadUint64(&evicted))
+	}
+
+	for i := 0; i < 3; i++ {
+		<-errs
+	}
+}
+
+func TestSetTTLReturning(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	if prev, existed := c.SetTTLReturning("key", "value", 60); existed || !prev.IsZero() {
+		t.Errorf("Unexpected previous expiration %s", prev)
+	}
+
+	c.Set("permanent", "value")
+
+	if prev, existed := c.SetTTLReturning("permanent", "value", 60); !existed || !prev.IsZero() {
+		t.Errorf("Unexpected previous expiration %s", prev)
+	}
+
+	prev, existed := c.SetTTLReturning("key", "value", 120)
+	if !existed {
+		t.Error("Expected key to exist")
+	}
+
+	if d := time.Until(prev); d <= 0 || d > 60*time.Second {
+		t.Errorf("Unexpected previous expiration %s", prev)
+	}
+}
+
+func TestSetTTLExtend(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	if !c.SetTTLExtend("key", "first", 60) {
+		t.Error("Expected TTL to be set for a new key")
+	}
+
+	// A shorter TTL doesn't shorten
+	// the expiration but sets the value.
+	if c.SetTTLExtend("key", "second", 10) {
+		t.Error("Expected shorter TTL not to be set")
+	}
+
+	if v := c.Get("key"); v != "second" {
+		t.Errorf("Expected value second, got %v", v)
+	}
+
+	if n := len(c.ExpiringWithin(30 * time.Second)); n != 0 {
+		t.Errorf("Expected no keys expiring within 30s, got %d", n)
+	}
+
+	if !c.SetTTLExtend("key", "third", 120) {
+		t.Error("Expected longer TTL to be set")
+	}
+
+	if n := len(c.ExpiringWithin(90 * time.Second)); n != 0 {
+		t.Errorf("Expected no keys expiring within 90s, got %d", n)
+	}
+
+	// Keys without a TTL are left without one.
+	c.Set("permanent", "value")
+
+	if c.SetTTLExtend("permanent", "value", 60) {
+		t.Error("Expected TTL not to be set for a key without a TTL")
+	}
+
+	if n := c.TTLCount(); n != 1 {
+		t.Errorf("Expected TTL count 1, got %d", n)
+	}
+}
+
+func TestSetTTLBatch(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MRUSize:    8,
+		ShardCount: 2,
+		AutoEvict:  60000,
+		NoOverflow: true,
+	})
+
+	c.Set("0", "value")
+
+	items := map[string]interface{}{}
+	for i := 0; i < 10; i++ {
+		items[strconv.Itoa(i)] = i
+	}
+
+	// 8 fit, including the
+	// existing key.
+	if n := c.SetTTLBatch(items, 60); n != 8 {
+		t.Errorf("Expected 8 items set, got %d", n)
+	}
+
+	stats := c.Stats()
+
+	if stats.TTLKeys != 8 || stats.Overflows != 2 || stats.Sets != 9 {
+		t.Errorf("Expected 8 TTL keys, 2 overflows and 9 sets, got %d, %d and %d",
+			stats.TTLKeys, stats.Overflows, stats.Sets)
+	}
+
+	if c.Get("0") != 0 {
+		t.Error(`Expected key "0" to be updated`)
+	}
+
+	for _, k := range c.ExpiringWithin(time.Minute) {
+		if k.TTL <= 59*time.Second {
+			t.Errorf(`Expected key "%s" TTL of ~60s, got %s`, k.Key, k.TTL)
+		}
+	}
+
+	// Past TTLs are evicted.
+	if n := c.SetTTLBatch(map[string]interface{}{"0": "value"}, -1); n != 1 {
+		t.Errorf("Expected 1 item set, got %d", n)
+	}
+
+	c.SyncEvict()
+
+	if c.Get("0") != nil {
+		t.Error(`Expected key "0" to be expired`)
+	}
+}
+
+func TestSetChanged(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	if !c.SetChanged("key", "value") {
+		t.Error("Set failed")
+	}
+
+	if c.SetChanged("key", "value") {
+		t.Error("Expected set of unchanged value to be skipped")
+	}
+
+	if !c.SetChanged("key", "value2") {
+		t.Error("Expected set of changed value to be applied")
+	}
+
+	// Non-comparable values are always set.
+	c.SetChanged("bytes", []byte("value"))
+	if !c.SetChanged("bytes", []byte("value")) {
+		t.Error("Expected set of non-comparable value to be applied")
+	}
+}
+
+func TestSetIfNewer(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	if !c.SetIfNewer("key", "v2", 2) {
+		t.Error("Set failed")
+	}
+
+	// An older version shouldn't be stored.
+	if c.SetIfNewer("key", "v1", 1) {
+		t.Error("Expected older version to be rejected")
+	}
+
+	if c.Get("key") != "v2" {
+		t.Errorf(`Expected value "v2", got "%s"`, c.Get("key"))
+	}
+
+	if !c.SetIfNewer("key", "v3", 3) {
+		t.Error("Expected newer version to be stored")
+	}
+
+	if c.Get("key") != "v3" {
+		t.Errorf(`Expected value "v3", got "%s"`, c.Get("key"))
+	}
+}
+
+func TestIncrTTL(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	v, ok := c.IncrTTL("counter", 5, 60)
+	if !ok || v != 5 {
+		t.Errorf("Expected value 5, got %d", v)
+	}
+
+	v, ok = c.IncrTTL("counter", -2, 60)
+	if !ok || v != 3 {
+		t.Errorf("Expected value 3, got %d", v)
+	}
+
+	if c.Get("counter") != int64(3) {
+		t.Error("Get failed")
+	}
+
+	// Non-int64 values can't be incremented.
+	c.Set("key", "value")
+	if _, ok := c.IncrTTL("key", 1, 60); ok {
+		t.Error("Expected incr on non-counter to fail")
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	c.SetTTL("short", "value", 5)
+	c.SetTTL("shorter", "value", 2)
+	c.SetTTL("long", "value", 3600)
+	c.Set("permanent", "value")
+
+	expiring := c.ExpiringWithin(10 * time.Second)
+
+	if len(expiring) != 2 {
+		t.Fatalf("Expected 2 expiring keys, got %d", len(expiring))
+	}
+
+	// Results are sorted by remaining TTL.
+	expected := []string{"shorter", "short"}
+	for i, k := range expiring {
+		if k.Key != expected[i] {
+			t.Errorf(`Expected key "%s" at position %d, got "%s"`, expected[i], i, k.Key)
+		}
+
+		if k.TTL <= 0 || k.TTL > 10*time.Second {
+			t.Errorf("Unexpected remaining TTL %s", k.TTL)
+		}
+	}
+}
+
+func TestWarm(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	warmed := c.Warm([]bicache.WarmEntry{
+		{Key: "ttl", Value: "value", Score: 5, TTL: 50 * time.Millisecond},
+		{Key: "permanent", Value: "value", Score: 10},
+		{Key: "expired", Value: "value", Score: 1, TTL: -time.Second},
+	})
+
+	if warmed != 2 {
+		t.Fatalf("Expected 2 warmed keys, got %d", warmed)
+	}
+
+	scores := map[string]uint64{}
+	for _, k := range c.List(10) {
+		scores[k.Key] = k.Score
+	}
+
+	if scores["ttl"] != 5 || scores["permanent"] != 10 {
+		t.Errorf("Unexpected scores: %v", scores)
+	}
+
+	if c.Get("expired") != nil {
+		t.Error("Expected expired entry to be skipped")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	c.SyncEvict()
+
+	if c.Get("ttl") != nil {
+		t.Error("Expected key ttl to be expired")
+	}
+
+	if c.Get("permanent") != "value" {
+		t.Error("Expected key permanent to persist")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	c.Set("permanent", "value")
+	c.SetTTL("ttl", "value", 60)
+	c.Get("permanent")
+
+	snapshot := c.Snapshot()
+
+	if len(snapshot) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(snapshot))
+	}
+
+	// Later mutations don't affect the snapshot.
+	c.Del("permanent")
+	c.Set("new", "value")
+
+	entries := map[string]bicache.WarmEntry{}
+	for _, e := range snapshot {
+		entries[e.Key] = e
+	}
+
+	if e := entries["permanent"]; e.Value != "value" || e.Score != 1 || e.TTL != 0 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	if e := entries["ttl"]; e.TTL <= 0 || e.TTL > 60*time.Second {
+		t.Errorf("Unexpected TTL %s", e.TTL)
+	}
+
+	// Snapshots can be restored with Warm.
+	c2, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	if n := c2.Warm(snapshot); n != 2 {
+		t.Errorf("Expected 2 warmed keys, got %d", n)
+	}
+}
+
+func TestSnapshotTop(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 10; i++ {
+		k := strconv.Itoa(i)
+		c.Set(k, i)
+		for j := 0; j < i; j++ {
+			c.Get(k)
+		}
+	}
+
+	c.SetTTL("hot-ttl", "value", 60)
+	for j := 0; j < 20; j++ {
+		c.Get("hot-ttl")
+	}
+
+	var buf bytes.Buffer
+	if err := c.SnapshotTop(&buf, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	n, err := c2.Restore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Fatalf("Expected 3 restored keys, got %d", n)
+	}
+
+	expected := map[string]uint64{"hot-ttl": 20, "9": 9, "8": 8}
+	for _, k := range c2.List(10) {
+		if expected[k.Key] != k.Score {
+			t.Errorf("Unexpected key %s with score %d", k.Key, k.Score)
+		}
+	}
+
+	if c2.Get("9") != 9 || c2.TTLCount() != 1 {
+		t.Error("Restore failed")
+	}
+}
+
+func TestState(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	c.Set("key", "value")
+
+	if state, exists := c.State("key"); !exists || state != 0 {
+		t.Errorf("Expected key in state 0, got %d (exists: %t)", state, exists)
+	}
+
+	c.Promote("key")
+
+	if state, exists := c.State("key"); !exists || state != 1 {
+		t.Errorf("Expected key in state 1, got %d (exists: %t)", state, exists)
+	}
+
+	if _, exists := c.State("missing"); exists {
+		t.Error("Expected missing key not to exist")
+	}
+
+	// State doesn't increase the score.
+	if score := c.List(1)[0].Score; score != 0 {
+		t.Errorf("Expected score 0, got %d", score)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    1,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+	})
+
+	c.SetMeta("missing", "meta")
+	if _, exists := c.GetMeta("missing"); exists {
+		t.Error("Expected missing key")
+	}
+
+	c.Set("key", "value")
+	c.SetMeta("key", "application/json")
+
+	// Metadata is preserved across
+	// updates and promotions.
+	c.Set("key", "value2")
+	c.Promote("key")
+
+	if meta, exists := c.GetMeta("key"); !exists || meta != "application/json" {
+		t.Errorf("Unexpected metadata %v", meta)
+	}
+
+	c.Del("key")
+	if _, exists := c.GetMeta("key"); exists {
+		t.Error("Expected metadata to be removed")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	appendValue := func(old interface{}) interface{} {
+		return append(old.([]string), "value")
+	}
+
+	if c.Update("key", appendValue) {
+		t.Error("Expected update of a missing key to fail")
+	}
+
+	c.Set("key", []string{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if !c.Update("key", appendValue) {
+					t.Error("Update failed")
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := len(c.Get("key").([]string)); n != 100 {
+		t.Errorf("Expected 100 appended values, got %d", n)
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	// Keys in different shards.
+	a, b := c.KeyForShard("a", 0), c.KeyForShard("b", 3)
+	keys := []string{a, b}
+
+	c.Set(a, 100)
+	c.Set(b, 0)
+
+	// Concurrent transfers and
+	// consistent reads.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				from, to := keys[i%2], keys[(i+1)%2]
+				c.Atomic(keys, func(tx *bicache.Tx) error {
+					tx.Set(from, tx.Get(from).(int)-1)
+					tx.Set(to, tx.Get(to).(int)+1)
+					return nil
+				})
+
+				c.Atomic(keys, func(tx *bicache.Tx) error {
+					if sum := tx.Get(a).(int) + tx.Get(b).(int); sum != 100 {
+						t.Errorf("Expected sum 100, got %d", sum)
+					}
+					return nil
+				})
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Errors discard changes.
+	errAbort := fmt.Errorf("abort")
+	err := c.Atomic(keys, func(tx *bicache.Tx) error {
+		tx.Del(a)
+		tx.Set(b, 100)
+
+		if tx.Get(a) != nil || tx.Get(b) != 100 {
+			t.Error("Expected reads of pending writes")
+		}
+
+		if tx.Set("undeclared", "value") {
+			t.Error("Expected set of undeclared key to fail")
+		}
+
+		return errAbort
+	})
+
+	if err != errAbort {
+		t.Errorf("Expected error %v, got %v", errAbort, err)
+	}
+
+	if c.Get(a) == nil || c.Get(a).(int)+c.Get(b).(int) != 100 {
+		t.Error("Expected aborted changes to be discarded")
+	}
+
+	c.Atomic(keys, func(tx *bicache.Tx) error {
+		tx.Del(a)
+		tx.Set(b, 100)
+		return nil
+	})
+
+	if c.Get(a) != nil || c.Get(b) != 100 {
+		t.Error("Expected changes to be applied")
+	}
+
+	// New keys that don't fit with NoOverflow
+	// reject the whole transaction.
+	c, _ = bicache.New(&bicache.Config{
+		MRUSize:    2,
+		ShardCount: 1,
+		NoOverflow: true,
+	})
+
+	c.Set("0", "value")
+
+	err = c.Atomic([]string{"0", "1", "2"}, func(tx *bicache.Tx) error {
+		tx.Set("0", "new")
+		tx.Set("1", "value")
+		tx.Set("2", "value")
+		return nil
+	})
+
+	if err != bicache.ErrRejected {
+		t.Errorf("Expected error %v, got %v", bicache.ErrRejected, err)
+	}
+
+	if c.Get("0") != "value" || c.Get("1") != nil {
+		t.Error("Expected rejected changes to be discarded")
+	}
+}
+
+func TestGetOrSetTTL(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	if v, loaded := c.GetOrSetTTL("key", "first", 60); loaded || v != "first" {
+		t.Errorf("Expected first value to be set, got %v", v)
+	}
+
+	if v, loaded := c.GetOrSetTTL("key", "second", 60); !loaded || v != "first" {
+		t.Errorf("Expected existing value, got %v", v)
+	}
+
+	// Expired but unswept keys are replaced.
+	c.SetTTL("expired", "stale", -1)
+
+	if v, loaded := c.GetOrSetTTL("expired", "fresh", 60); loaded || v != "fresh" {
+		t.Errorf("Expected fresh value to be set, got %v", v)
+	}
+
+	if c.Get("expired") != "fresh" {
+		t.Error("Expected fresh value to be stored")
+	}
+
+	if n := c.TTLCount(); n != 2 {
+		t.Errorf("Expected TTL count 2, got %d", n)
+	}
+}
+
+func TestGetRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  60000,
+		Clock:      clock,
+	})
+
+	c.SetTTL("session", "value", 10)
+	c.Set("plain", "value")
+
+	// Each refresh extends the
+	// expiration by 10 seconds.
+	for i := 0; i < 3; i++ {
+		clock.Advance(8 * time.Second)
+
+		if c.GetRefresh("session", 10) != "value" {
+			t.Fatalf("Expected key session to exist after %d refreshes", i)
+		}
+
+		c.SyncEvict()
+	}
+
+	if c.GetRefresh("plain", 10) != "value" {
+		t.Error("Expected key plain to exist")
+	}
+
+	if n := c.TTLCount(); n != 1 {
+		t.Errorf("Expected TTL count 1, got %d", n)
+	}
+
+	if c.GetRefresh("missing", 10) != nil {
+		t.Error("Expected nil for missing key")
+	}
+
+	clock.Advance(11 * time.Second)
+
+	// Expired keys aren't refreshed.
+	if c.GetRefresh("session", 10) != nil {
+		t.Error("Expected key session to be expired")
+	}
+
+	if stats := c.Stats(); stats.Hits != 4 || stats.Misses != 2 {
+		t.Errorf("Expected 4 hits and 2 misses, got %d and %d", stats.Hits, stats.Misses)
+	}
+}
+
+func TestGetOrLoadTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  60000,
+		Clock:      clock,
+	})
+
+	var loads int
+	loader := func() (interface{}, time.Duration, error) {
+		loads++
+		return "value", time.Minute, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if v, err := c.GetOrLoadTTL("key", loader); err != nil || v != "value" {
+			t.Errorf("Expected value, got %v, %v", v, err)
+		}
+	}
+
+	if loads != 1 {
+		t.Errorf("Expected 1 load, got %d", loads)
+	}
+
+	if keys := c.ExpiringWithin(2 * time.Minute); len(keys) != 1 || keys[0].Key != "key" {
+		t.Errorf("Expected key to have the loaded TTL, got %v", keys)
+	}
+
+	// Loader errors are returned
+	// and nothing is set.
+	_, err := c.GetOrLoad("error", func() (interface{}, error) {
+		return nil, fmt.Errorf("load failed")
+	})
+
+	if err == nil || c.Get("error") != nil {
+		t.Errorf("Expected load error and no value, got %v", err)
+	}
+
+	// Loaded values without
+	// a TTL are set without one.
+	if v, err := c.GetOrLoad("plain", func() (interface{}, error) {
+		return "value", nil
+	}); err != nil || v != "value" {
+		t.Errorf("Expected value, got %v, %v", v, err)
+	}
+
+	if n := c.TTLCount(); n != 1 {
+		t.Errorf("Expected TTL count 1, got %d", n)
+	}
+
+	// Expired but unswept keys are reloaded.
+	clock.Advance(2 * time.Minute)
+
+	if _, err := c.GetOrLoadTTL("key", loader); err != nil || loads != 2 {
+		t.Errorf("Expected expired key to be reloaded, got %d loads, %v", loads, err)
+	}
+}
+
+func TestGetOrLoadConcurrent(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	c.Set("dep", "dep")
+
+	// Loaders may call back into the cache,
+	// including keys on the same shard.
+	v, err := c.GetOrLoad("key", func() (interface{}, error) {
+		return c.Get("dep").(string) + "-loaded", nil
+	})
+
+	if err != nil || v != "dep-loaded" || c.Get("key") != "dep-loaded" {
+		t.Errorf("Expected dep-loaded, got %v, %v", v, err)
+	}
+
+	// Concurrent loads of the same
+	// missing key call loader once.
+	var loads int32
+	release := make(chan struct{})
+	loader := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.GetOrLoad("shared", loader)
+		}(i)
+	}
+
+	// Other keys are readable
+	// while the load is in flight.
+	for atomic.LoadInt32(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if c.Get("dep") != "dep" {
+		t.Error("Expected dep to be readable during load")
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("Expected 1 load, got %d", n)
+	}
+
+	for _, r := range results {
+		if r != "value" {
+			t.Errorf("Expected value, got %v", r)
+		}
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 20; i++ {
+		k := strconv.Itoa(i)
+		c.Set(k, "value")
+		for j := 0; j < i; j++ {
+			c.Get(k)
+		}
+	}
+
+	c.Promote("19")
+
+	hot := c.HotKeys(3)
+
+	if len(hot) != 3 {
+		t.Fatalf("Expected 3 hot keys, got %d", len(hot))
+	}
+
+	expected := []string{"19", "18", "17"}
+	for i, k := range hot {
+		if k.Key != expected[i] {
+			t.Errorf(`Expected key "%s" at position %d, got "%s"`, expected[i], i, k.Key)
+		}
+	}
+
+	if hot[0].State != 1 || hot[0].Score != 19 {
+		t.Errorf("Unexpected key info %+v", hot[0])
+	}
+}
+
+func TestHotKeysConcurrent(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    100,
+		MRUSize:    100,
+		ShardCount: 4,
+		AutoEvict:  60000,
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// Set, get and delete
+	// keys in the background.
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				k := strconv.Itoa((i*4 + w) % 300)
+				c.Set(k, "value")
+				c.Get(k)
+				if i%3 == 0 {
+					c.Del(strconv.Itoa((i*4 + w + 150) % 300))
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 1000; i++ {
+		hot := c.HotKeys(10)
+		for j := 1; j < len(hot); j++ {
+			if hot[j].Score > hot[j-1].Score {
+				t.Fatalf("HotKeys not in descending score order: %v", hot)
+			}
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestRandomKey(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 8,
+		AutoEvict:  10000,
+	})
+
+	if _, ok := c.RandomKey(); ok {
+		t.Error("Expected no key from an empty cache")
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		k, ok := c.RandomKey()
+		if !ok {
+			t.Fatal("Expected a key")
+		}
+
+		if n, err := strconv.Atoi(k); err != nil || n < 0 || n > 9 {
+			t.Fatalf(`Unexpected key "%s"`, k)
+		}
+
+		seen[k] = true
+	}
+
+	if len(seen) < 5 {
+		t.Errorf("Expected at least 5 distinct keys, got %d", len(seen))
+	}
+
+	// Sampling doesn't
+	// affect scores.
+	for _, k := range c.List(10) {
+		if k.Score != 0 {
+			t.Errorf(`Expected key "%s" score 0, got %d`, k.Key, k.Score)
+		}
+	}
+}
+
+func TestKeysOfType(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	type item struct{ Name string }
+
+	c.Set("a", item{Name: "a"})
+	c.Set("b", &item{Name: "b"})
+	c.Set("c", item{Name: "c"})
+	c.Set("d", "value")
+
+	keys := c.KeysOfType(item{})
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Errorf("Expected keys [a c], got %v", keys)
+	}
+
+	keys = c.KeysOfType(&item{})
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("Expected keys [b], got %v", keys)
+	}
+
+	if keys = c.KeysOfType(0); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    1,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+	})
+
+	c.Set("hot", "value")
+	c.Set("hotter", "value")
+	c.Get("hot")
+
+	if !c.Promote("hot") {
+		t.Error("Promote failed")
+	}
+
+	if c.Promote("nil") {
+		t.Error("Expected promote of missing key to fail")
+	}
+
+	stats := c.Stats()
+	if stats.MFUSize != 1 || stats.MRUSize != 1 {
+		t.Errorf("Expected MFU/MRU sizes 1/1, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	// Promoting into a full MFU
+	// demotes the existing key.
+	if !c.Promote("hotter") {
+		t.Error("Promote failed")
+	}
+
+	for _, k := range c.List(2) {
+		switch {
+		case k.Key == "hotter" && k.State != 1:
+			t.Errorf(`Expected key "hotter" in state 1, got %d`, k.State)
+		case k.Key == "hot" && k.State != 0:
+			t.Errorf(`Expected key "hot" in state 0, got %d`, k.State)
+		}
+	}
+}
+
+func TestPromoteWorkingSet(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    3,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+	})
+
+	c.Set("mfu", "value")
+	c.Promote("mfu")
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	// Give keys 7-9 the
+	// highest scores.
+	for i := 7; i < 10; i++ {
+		for j := 0; j < i; j++ {
+			c.Get(strconv.Itoa(i))
+		}
+	}
+
+	// Only 2 MFU slots are free.
+	if n := c.PromoteWorkingSet(); n != 2 {
+		t.Errorf("Expected 2 keys promoted, got %d", n)
+	}
+
+	for _, k := range []string{"mfu", "8", "9"} {
+		if state, _ := c.State(k); state != 1 {
+			t.Errorf(`Expected key "%s" in state 1, got %d`, k, state)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.MFUSize != 3 || stats.MRUSize != 8 {
+		t.Errorf("Expected MFU/MRU sizes 3/8, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+
+	// The MFU is full.
+	if n := c.PromoteWorkingSet(); n != 0 {
+		t.Errorf("Expected 0 keys promoted, got %d", n)
+	}
+}
+
+func TestDemote(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+	})
+
+	c.Set("key", "value")
+
+	// Not in the MFU.
+	if c.Demote("key") {
+		t.Error("Expected demote of MRU key to fail")
+	}
+
+	c.Promote("key")
+
+	if !c.Demote("key") {
+		t.Error("Demote failed")
+	}
+
+	stats := c.Stats()
+	if stats.MFUSize != 0 || stats.MRUSize != 1 {
+		t.Errorf("Expected MFU/MRU sizes 0/1, got %d/%d", stats.MFUSize, stats.MRUSize)
+	}
+}
+
+func TestGetOrSetFunc(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	var calls int32
+	f := func() interface{} {
+		atomic.AddInt32(&calls, 1)
+		return "value"
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(100)
+
+	for i := 0; i < 100; i++ {
+		go func() {
+			defer wg.Done()
+			if v := c.GetOrSetFunc("key", f); v != "value" {
+				t.Errorf(`Expected value "value", got "%v"`, v)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+
+	if c.Get("key") != "value" {
+		t.Error("Get failed")
+	}
+
+	// Expired but unswept keys are
+	// replaced without AutoEvict.
+	clock := &fakeClock{now: time.Now()}
+	c, _ = bicache.New(&bicache.Config{
+		MRUSize:    30,
+		ShardCount: 1,
+		Clock:      clock,
+	})
+
+	c.SetTTL("ttl", "stale", 10)
+	clock.Advance(time.Minute)
+
+	if v := c.GetOrSetFunc("ttl", f); v != "value" {
+		t.Errorf(`Expected value "value", got "%v"`, v)
+	}
+}
+
+func TestDel(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	c.Set("key", "value")
+	c.Del("key")
+
+	if c.Get("key") != nil {
+		t.Error("Delete failed")
+	}
+
+	stats := c.Stats()
+
+	if stats.MRUSize != 0 {
+		t.Errorf("Expected MRU size 0, got %d", stats.MRUSize)
+	}
+}
+
+func TestDelEntryReuse(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+	})
+
+	// Removed entries are pooled and
+	// reused; none of the removed key's
+	// state may carry over.
+	for i := 0; i < 10; i++ {
+		c.SetWithPriority("old", "value", 5)
+		c.SetTTL("old", "value", 60)
+		c.SetMeta("old", "meta")
+		c.Get("old")
+		c.Del("old")
+
+		k := strconv.Itoa(i)
+		c.Set(k, "new")
+
+		if meta, _ := c.GetMeta(k); meta != nil {
+			t.Fatalf("Unexpected meta %v for key %s", meta, k)
+		}
+
+		keys := c.List(1)
+		if keys[0].Key != k || keys[0].Score != 0 || keys[0].Priority != 0 {
+			t.Fatalf("Unexpected key info %+v", keys[0])
+		}
+
+		if n := c.TTLCount(); n != 0 {
+			t.Fatalf("Expected TTL count 0, got %d", n)
+		}
+
+		c.Del(k)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDelReturn(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	c.SetTTL("key", "value", 60)
+
+	v, existed := c.DelReturn("key")
+	if !existed || v != "value" {
+		t.Errorf("Unexpected value %v", v)
+	}
+
+	if c.Get("key") != nil || c.TTLCount() != 0 {
+		t.Error("Expected key to be deleted")
+	}
+
+	if _, existed := c.DelReturn("key"); existed {
+		t.Error("Expected key to not exist")
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	var evicted []string
+
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+		OnEvict: func(k string, v interface{}) {
+			evicted = append(evicted, k)
+		},
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if n := c.EvictLRU(3); n != 3 {
+		t.Errorf("Expected 3 evictions, got %d", n)
+	}
+
+	// The oldest keys are evicted first.
+	for i, k := range []string{"0", "1", "2"} {
+		if c.Get(k) != nil {
+			t.Errorf(`Expected key "%s" to be evicted`, k)
+		}
+
+		if evicted[i] != k {
+			t.Errorf(`Expected OnEvict for key "%s", got "%s"`, k, evicted[i])
+		}
+	}
+
+	// Can't evict more than exists.
+	if n := c.EvictLRU(100); n != 7 {
+		t.Errorf("Expected 7 evictions, got %d", n)
+	}
+
+	if stats := c.Stats(); stats.Evictions != 10 {
+		t.Errorf("Expected 10 evictions, got %d", stats.Evictions)
+	}
+
+	// Keys vetoed by CanEvict
+	// aren't counted.
+	c, _ = bicache.New(&bicache.Config{
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  10000,
+		CanEvict: func(k string, v interface{}) bool {
+			return k != "0" && k != "1"
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if n := c.EvictLRU(5); n != 3 {
+		t.Errorf("Expected 3 evictions, got %d", n)
+	}
+
+	if stats := c.Stats(); stats.Evictions != 3 || stats.MRUSize != 2 {
+		t.Errorf("Expected 3 evictions and 2 keys, got %d and %d", stats.Evictions, stats.MRUSize)
+	}
+}
+
+func TestReclaim(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 1,
+		AutoEvict:  60000,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.SetTTL(strconv.Itoa(i), "value", 60)
+	}
+
+	c.Get("9")
+
+	// Values are reclaimed from the MRU tail,
+	// which holds the first keys set.
+	if n := c.Reclaim(3); n != 3 {
+		t.Errorf("Expected 3 values reclaimed, got %d", n)
 	}
 
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		_ = c.List(b.N / 2)
+	for i := 0; i < 10; i++ {
+		k := strconv.Itoa(i)
+		if v := c.Get(k); (v == nil) != (i < 3) {
+			t.Errorf("Unexpected value %v for key %s", v, k)
+		}
 	}
-}
 
-// Tests
+	// Reclaimed keys retain their metadata.
+	if state, ok := c.State("0"); !ok || state != 0 {
+		t.Error("Expected reclaimed key 0 to exist")
+	}
 
-func TestSetGet(t *testing.T) {
-	c, _ := bicache.New(&bicache.Config{
-		MFUSize:    10,
-		MRUSize:    30,
-		ShardCount: 2,
-		AutoEvict:  10000,
-	})
+	if n := c.TTLCount(); n != 10 {
+		t.Errorf("Expected TTL count 10, got %d", n)
+	}
 
-	ok := c.Set("key", "value")
-	if !ok {
-		t.Error("Set failed")
+	if n := len(c.Dump()); n != 7 {
+		t.Errorf("Expected 7 dumped keys, got %d", n)
 	}
 
-	if c.Get("key") != "value" {
-		t.Error("Get failed")
+	if stats := c.Stats(); stats.Misses != 3 || stats.MRUSize != 10 {
+		t.Errorf("Expected 3 misses and 10 keys, got %d and %d", stats.Misses, stats.MRUSize)
 	}
 
-	// Ensure that updates work.
-	ok = c.Set("key", "value2")
-	if !ok {
-		t.Error("Update failed")
+	// Already reclaimed values are skipped.
+	if n := c.Reclaim(2); n != 2 {
+		t.Errorf("Expected 2 values reclaimed, got %d", n)
 	}
 
-	if c.Get("key") != "value2" {
-		t.Error("Update failed")
+	if c.Get("3") != nil || c.Get("4") != nil {
+		t.Error("Expected keys 3 and 4 to be reclaimed")
 	}
-}
 
-func TestSetTTL(t *testing.T) {
-	c, _ := bicache.New(&bicache.Config{
-		MFUSize:    10,
-		MRUSize:    30,
-		ShardCount: 2,
-		AutoEvict:  1000,
+	// A reload restores the value.
+	v, err := c.GetOrLoad("0", func() (interface{}, error) {
+		return "reloaded", nil
 	})
 
-	ok := c.SetTTL("key", "value", 3)
-	if !ok {
-		t.Error("Set failed")
+	if err != nil || v != "reloaded" || c.Get("0") != "reloaded" {
+		t.Errorf("Expected reloaded value, got %v", c.Get("0"))
 	}
 
-	if c.Get("key") != "value" {
-		t.Error("Get failed")
+	c.Set("1", "set")
+	if v, ok := c.DelReturn("2"); ok || v != nil {
+		t.Errorf("Expected reclaimed key 2 to return no value, got %v", v)
 	}
 
-	log.Printf("Sleeping for 4 seconds to allow evictions")
-	time.Sleep(4 * time.Second)
+	if c.Get("1") != "set" {
+		t.Error("Expected set to restore key 1")
+	}
 
-	if c.Get("key") != nil {
-		t.Error("Key TTL expiration failed")
+	if err := c.Validate(); err != nil {
+		t.Error(err)
 	}
 }
 
-func TestDel(t *testing.T) {
+func TestEvictLFU(t *testing.T) {
 	c, _ := bicache.New(&bicache.Config{
 		MFUSize:    10,
 		MRUSize:    30,
-		ShardCount: 2,
+		ShardCount: 4,
 		AutoEvict:  10000,
 	})
 
-	c.Set("key", "value")
-	c.Del("key")
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
 
-	if c.Get("key") != nil {
-		t.Error("Delete failed")
+	// Keys 0-2 are left cold.
+	for i := 3; i < 10; i++ {
+		c.Get(strconv.Itoa(i))
 	}
 
-	stats := c.Stats()
+	if n := c.EvictLFU(3); n != 3 {
+		t.Errorf("Expected 3 evictions, got %d", n)
+	}
 
-	if stats.MRUSize != 0 {
-		t.Errorf("Expected MRU size 0, got %d", stats.MRUSize)
+	for i := 0; i < 10; i++ {
+		v := c.Get(strconv.Itoa(i))
+		if i < 3 && v != nil {
+			t.Errorf("Expected key %d to be evicted", i)
+		}
+		if i >= 3 && v == nil {
+			t.Errorf("Unexpected miss for key %d", i)
+		}
 	}
 }
 
@@ -259,6 +2584,173 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListLimits(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  60000,
+	})
+
+	// Empty and populated caches
+	// behave the same for n <= 0.
+	for _, fill := range []int{0, 20} {
+		for i := 0; i < fill; i++ {
+			c.Set(strconv.Itoa(i), "value")
+		}
+
+		for _, n := range []int{0, -1, -1000000} {
+			if list := c.List(n); len(list) != 0 {
+				t.Errorf("Expected list output len of 0 for n %d, got %d", n, len(list))
+			}
+		}
+	}
+
+	// Every key is listed when n
+	// exceeds the number cached.
+	if list := c.List(1000000); len(list) != 20 {
+		t.Errorf("Expected list output len of 20, got %d", len(list))
+	}
+}
+
+func TestListSparse(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    100000,
+		MRUSize:    100000,
+		ShardCount: 2,
+		AutoEvict:  60000,
+	})
+
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	c.Promote("0")
+
+	// Results are sized to the keys
+	// cached rather than the capacity.
+	list := c.List(1000)
+
+	if len(list) != 5 {
+		t.Errorf("Expected list output len of 5, got %d", len(list))
+	}
+
+	if cap(list) >= 1000 {
+		t.Errorf("Expected list capacity near 5, got %d", cap(list))
+	}
+
+	// Keys in both tiers are listed.
+	states := map[string]uint8{}
+	for _, ki := range list {
+		states[ki.Key] = ki.State
+	}
+
+	if len(states) != 5 || states["0"] != 1 || states["1"] != 0 {
+		t.Errorf("Unexpected listed keys and states %v", states)
+	}
+}
+
+func TestListMaxResults(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:        10,
+		MRUSize:        30,
+		ShardCount:     4,
+		AutoEvict:      60000,
+		MaxListResults: 5,
+	})
+
+	for i := 0; i < 20; i++ {
+		k := strconv.Itoa(i)
+		c.Set(k, "value")
+		for j := 0; j < i; j++ {
+			c.Get(k)
+		}
+	}
+
+	c.SyncEvict()
+
+	list := c.List(100)
+
+	if len(list) != 5 {
+		t.Fatalf("Expected list output len of 5, got %d", len(list))
+	}
+
+	expected := []string{"19", "18", "17", "16", "15"}
+	for i, n := range list {
+		if n.Key != expected[i] {
+			t.Errorf(`Expected key "%s" at list element %d, got "%s"`,
+				expected[i], i, n.Key)
+		}
+	}
+
+	// Without a cap, every key is listed.
+	c, _ = bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  60000,
+	})
+
+	for i := 0; i < 20; i++ {
+		c.Set(strconv.Itoa(i), "value")
+	}
+
+	if n := len(c.List(100)); n != 20 {
+		t.Errorf("Expected list output len of 20, got %d", n)
+	}
+}
+
+func TestDump(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 2,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	dump := c.Dump()
+
+	if len(dump) != 10 {
+		t.Errorf("Expected dump len of 10, got %d", len(dump))
+	}
+
+	for i := 0; i < 10; i++ {
+		if dump[strconv.Itoa(i)] != i {
+			t.Errorf("Expected value %d, got %v", i, dump[strconv.Itoa(i)])
+		}
+	}
+
+	c.Get("3")
+	c.Get("3")
+	c.Get("7")
+
+	dump = c.DumpN(2)
+
+	if len(dump) != 2 {
+		t.Errorf("Expected dump len of 2, got %d", len(dump))
+	}
+
+	for _, k := range []string{"3", "7"} {
+		if _, ok := dump[k]; !ok {
+			t.Errorf(`Expected key "%s" in dump`, k)
+		}
+	}
+
+	for _, n := range []int{0, -1} {
+		if dump = c.DumpN(n); len(dump) != 0 {
+			t.Errorf("Expected empty dump for n %d, got %d keys", n, len(dump))
+		}
+	}
+
+	if dump = c.DumpN(20); len(dump) != 10 {
+		t.Errorf("Expected dump len of 10, got %d", len(dump))
+	}
+}
+
 func TestFlushMRU(t *testing.T) {
 	c, _ := bicache.New(&bicache.Config{
 		MFUSize:    10,
@@ -393,6 +2885,181 @@ func TestFlushAll(t *testing.T) {
 	}
 }
 
+func TestFlushExcept(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 20; i++ {
+		c.SetTTL(strconv.Itoa(i), i, 60)
+	}
+
+	c.Get("3")
+
+	if n := c.FlushExcept([]string{"3", "7", "missing"}); n != 18 {
+		t.Errorf("Expected 18 keys flushed, got %d", n)
+	}
+
+	keys := c.List(10)
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(keys))
+	}
+
+	if keys[0].Key != "3" || keys[0].Score != 1 {
+		t.Errorf(`Expected key "3" with score 1, got %s with %d`, keys[0].Key, keys[0].Score)
+	}
+
+	if n := c.TTLCount(); n != 2 {
+		t.Errorf("Expected TTL count 2, got %d", n)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 20; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	c.SetTTL("ttl", "value", 60)
+	c.SetMeta("0", "meta")
+	c.Promote("1")
+
+	for i := 0; i < 3; i++ {
+		c.Get("2")
+	}
+
+	cp, err := c.Copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+
+	if err := cp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, cpList := c.List(30), cp.List(30)
+	if len(list) != len(cpList) {
+		t.Fatalf("Expected list output len of %d, got %d", len(list), len(cpList))
+	}
+
+	for i, k := range list {
+		if *cpList[i] != *k {
+			t.Errorf("Expected %v at list element %d, got %v", *k, i, *cpList[i])
+		}
+	}
+
+	if meta, _ := cp.GetMeta("0"); meta != "meta" {
+		t.Errorf(`Expected meta "meta", got %v`, meta)
+	}
+
+	if len(cp.ExpiringWithin(time.Minute)) != 1 {
+		t.Error(`Expected key "ttl" to have a TTL`)
+	}
+
+	// The caches are independent.
+	cp.Set("3", "new")
+	cp.Del("4")
+	c.Set("5", "new")
+
+	if c.Get("3") != 3 || c.Get("4") != 4 {
+		t.Error("Expected original cache to be unchanged")
+	}
+
+	if cp.Get("3") != "new" || cp.Get("4") != nil || cp.Get("5") != 5 {
+		t.Error("Expected copied cache to be unchanged")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	c, _ := bicache.New(&bicache.Config{
+		MFUSize:    10,
+		MRUSize:    30,
+		ShardCount: 4,
+		AutoEvict:  10000,
+	})
+
+	for i := 0; i < 10; i++ {
+		c.SetTTL("old"+strconv.Itoa(i), "value", 60)
+	}
+
+	entries := map[string]interface{}{}
+	for i := 0; i < 20; i++ {
+		entries["new"+strconv.Itoa(i)] = i
+	}
+
+	if n := c.Swap(entries); n != 20 {
+		t.Errorf("Expected 20 entries swapped, got %d", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		if c.Get("old"+strconv.Itoa(i)) != nil {
+			t.Errorf("Expected key old%d to be replaced", i)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		if v := c.Get("new" + strconv.Itoa(i)); v != i {
+			t.Errorf("Expected value %d, got %v", i, v)
+		}
+	}
+
+	if n := c.TTLCount(); n != 0 {
+		t.Errorf("Expected TTL count 0, got %d", n)
+	}
+
+	// Entries beyond capacity are
+	// skipped with NoOverflow.
+	c, _ = bicache.New(&bicache.Config{
+		MRUSize:    10,
+		ShardCount: 1,
+		AutoEvict:  10000,
+		NoOverflow: true,
+	})
+
+	if n := c.Swap(entries); n != 10 {
+		t.Errorf("Expected 10 entries swapped, got %d", n)
+	}
+
+	// MFU-only caches swap into the MFU, and
+	// existing priorities are dropped.
+	c, _ = bicache.New(&bicache.Config{
+		MFUSize:    10,
+		ShardCount: 1,
+		AutoEvict:  10000,
+		NoOverflow: true,
+	})
+
+	c.SetWithPriority("new0", "value", 1)
+
+	if n := c.Swap(entries); n != 10 {
+		t.Errorf("Expected 10 entries swapped, got %d", n)
+	}
+
+	for _, k := range c.List(20) {
+		if k.State != 1 || k.Priority != 0 {
+			t.Errorf("Unexpected key %+v", k)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestIntegrity(t *testing.T) {
 	words := []string{"&c", "'d", "'em", "'ll", "'m", "'mid", "'midst", "'mongst", "'prentice", "'re", "'s", "'sblood", "'sbodikins", "'sdeath", "'sfoot", "'sheart", "'shun", "'slid", "'slife", "'slight", "'snails", "'strewth", "'t", "'til", "'tis", "'twas", "'tween", "'twere", "'twill", "'twixt", "'twould", "'un", "'ve", "1080", "10th", "1st", "2", "2nd", "3rd", "4th", "5th", "6th", "7th", "8th", "9th", "a", "a'", "a's", "a/c", "a1", "aa", "aaa", "aah", "aahed", "aahing", "aahs", "aal", "aalii", "aaliis", "aals", "aam", "aardvark", "aardvarks", "aardwolf", "aardwolves", "aargh", "aaron", "aaronic", "aarrgh", "aarrghh", "aas", "aasvogel", "aasvogels", "ab", "aba", "abac", "abaca", "abacas", "abacate", "abacaxi", "abacay", "abaci", "abacinate", "abacination", "abacisci", "abaciscus", "abacist", "aback", "abacli", "abacot", "abacterial", "abactinal", "abactinally", "abaction", "abactor", "abaculi", "abaculus", "abacus", "abacuses", "abada", "abaddon", "abadejo", "abadengo", "abadia", "abaff", "abaft", "abaisance", "abaised", "abaiser", "abaisse", "abaissed", "abaka", "abakas", "abalation", "abalienate", "abalienated", "abalienating", "abalienation", "abalone", "abalones", "abamp", "abampere", "abamperes", "abamps", "aband", "abandon", "abandonable", "abandoned", "abandonedly", "abandonee", "abandoner", "abandoners", "abandoning", "abandonment", "abandonments", "abandons", "abandum", "abanet", "abanga", "abannition", "abapical", "abaptiston", "abaptistum", "abarthrosis", "abarticular", "abarticulation", "abas", "abase", "abased", "abasedly", "abasedness", "abasement", "abasements", "abaser", "abasers", "abases", "abash", "abashed", "abashedly", "abashedness", "abashes", "abashing", "abashless", "abashlessly", "abashment", "abashments", "abasia", "abasias", "abasic", "abasing", "abasio", "abask", "abassi", "abastard", "abastardize", "abastral", "abatable", "abatage", "abate", "abated", "abatement", "abatements", "abater", "abaters", "abates", "abatic", "abating", "abatis", "abatised", "abatises", "abatjour", "abatjours", "abaton", "abator", "abators", "abattage", "abattis", "abattised", "abattises", "abattoir", "abattoirs", "abattu", "abattue", "abature", "abaue", "abave", "abaxial", "abaxile", "abay", "abayah", "abaze", "abb", "abba", "abbacies", "abbacomes", "abbacy", "abbandono", "abbas", "abbasi", "abbasid", "abbassi", "abbate", "abbatial", "abbatical", "abbatie", "abbaye", "abbe", "abbes", "abbess", "abbesses", "abbest", "abbevillian", "abbey", "abbey's", "abbeys", "abbeystead", "abbeystede", "abboccato", "abbogada", "abbot", "abbot's", "abbotcies", "abbotcy", "abbotnullius", "abbotric", "abbots", "abbotship", "abbotships", "abbott", "abbozzo", "abbr", "abbrev", "abbreviatable", "abbreviate", "abbreviated", "abbreviately", "abbreviates", "abbreviating", "abbreviation", "abbreviations", "abbreviator", "abbreviators", "abbreviatory", "abbreviature", "abbroachment", "abby", "abc", "abcess", "abcissa", "abcoulomb", "abd", "abdal", "abdali", "abdaria", "abdat", "abdest", "abdicable", "abdicant", "abdicate", "abdicated", "abdicates", "abdicating", "abdication", "abdications", "abdicative", "abdicator", "abditive", "abditory", "abdom", "abdomen", "abdomen's", "abdomens", "abdomina", "abdominal", "abdominales", "abdominalia", "abdominalian", "abdominally", "abdominals", "abdominoanterior", "abdominocardiac", "abdominocentesis", "abdominocystic", "abdominogenital", "abdominohysterectomy", "abdominohysterotomy", "abdominoposterior", "abdominoscope", "abdominoscopy", "abdominothoracic", "abdominous", "abdominovaginal", "abdominovesical", "abduce", "abduced", "abducens", "abducent", "abducentes", "abduces", "abducing", "abduct", "abducted", "abducting", "abduction", "abduction's", "abductions", "abductor", "abductor's", "abductores", "abductors", "abducts", "abeam", "abear", "abearance", "abecedaire", "abecedaria", "abecedarian", "abecedarians", "abecedaries", "abecedarium", "abecedarius", "abecedary", "abed", "abede", "abedge", "abegge", "abeigh", "abel", "abele", "abeles", "abelian", "abelite", "abelmosk", "abelmosks", "abelmusk", "abeltree", "abend", "abends", "abenteric", "abepithymia", "aberdavine", "aberdeen", "aberdevine", "aberduvine", "abernethy", "aberr", "aberrance", "aberrancies", "aberrancy", "aberrant", "aberrantly", "aberrants", "aberrate", "aberrated", "aberrating", "aberration", "aberrational", "aberrations", "aberrative", "aberrator", "aberrometer", "aberroscope", "aberuncate", "aberuncator", "abesse", "abessive", "abet", "abetment", "abetments", "abets", "abettal", "abettals", "abetted", "abetter", "abetters", "abetting", "abettor", "abettors", "abevacuation", "abey", "abeyance", "abeyances", "abeyancies", "abeyancy", "abeyant", "abfarad", "abfarads", "abhenries", "abhenry", "abhenrys", "abhinaya", "abhiseka", "abhominable", "abhor", "abhorred", "abhorrence", "abhorrences", "abhorrency", "abhorrent", "abhorrently", "abhorrer", "abhorrers", "abhorrible", "abhorring", "abhors", "abib", "abichite", "abidal", "abidance", "abidances", "abidden", "abide", "abided", "abider", "abiders", "abides", "abidi", "abiding", "abidingly", "abidingness", "abiegh", "abience", "abient", "abietate", "abietene", "abietic", "abietin", "abietineous", "abietinic", "abietite", "abigail", "abigails", "abigailship", "abigeat", "abigei", "abigeus", "abilao", "abilene", "abiliment", "abilitable", "abilities", "ability", "ability's", "abilla", "abilo", "abime", "abintestate", "abiogeneses", "abiogenesis", "abiogenesist", "abiogenetic", "abiogenetical", "abiogenetically", "abiogenist", "abiogenous", "abiogeny", "abiological", "abiologically", "abiology", "abioses", "abiosis", "abiotic", "abiotical", "abiotically", "abiotrophic", "abiotrophy", "abir", "abirritant", "abirritate", "abirritated", "abirritating", "abirritation", "abirritative", "abiston", "abit", "abiuret", "abject", "abjectedness", "abjection", "abjections"}
 
@@ -39,10 +39,11 @@ func (n *Node) Prev() *Node {
 	return nil
 }
 
-// Copy returns a copy of a *Node.
+// Copy returns an unlinked copy of a *Node.
+// The Value is copied by reference.
 func (n *Node) Copy() *Node {
 	return &Node{
-		Score: n.Score,
+		Score: atomic.LoadUint64(&n.Score),
 		Value: n.Value,
 	}
 }
@@ -97,10 +98,16 @@ func (ll *Sll) Tail() *Node {
 	return ll.root.next
 }
 
-// Copy returns a copy of a *Sll.
+// Copy returns a copy of a *Sll with copies
+// of its nodes, in the same order, linked
+// in the new *Sll.
 func (ll *Sll) Copy() *Sll {
 	newll := New()
 
+	if ll.Len() == 0 {
+		return newll
+	}
+
 	for node := ll.Head(); node != nil; node = node.Prev() {
 		c := node.Copy()
 		newll.PushTailNode(c)
@@ -133,16 +140,16 @@ func (ll *Sll) HighScores(k int) NodeScoreList {
 		node = node.Prev()
 	}
 
-	var min = h.Peek().(*Node).Score
+	var min = atomic.LoadUint64(&h.Peek().(*Node).Score)
 
 	// Iterate the rest of the list
 	// while maintaining the current
 	// heap len.
 	for ; node != nil; node = node.Prev() {
-		if node.Score > min {
+		if atomic.LoadUint64(&node.Score) > min {
 			heap.Push(h, node)
 			heap.Pop(h)
-			min = h.Peek().(*Node).Score
+			min = atomic.LoadUint64(&h.Peek().(*Node).Score)
 		}
 	}
 
@@ -173,16 +180,16 @@ func (ll *Sll) LowScores(k int) NodeScoreList {
 		node = node.Next()
 	}
 
-	var max = h.Peek().(*Node).Score
+	var max = atomic.LoadUint64(&h.Peek().(*Node).Score)
 
 	// Iterate the rest of the list
 	// while maintaining the current
 	// heap len.
 	for ; node != nil; node = node.Next() {
-		if node.Score < max {
+		if atomic.LoadUint64(&node.Score) < max {
 			heap.Push(h, node)
 			heap.Pop(h)
-			max = h.Peek().(*Node).Score
+			max = atomic.LoadUint64(&h.Peek().(*Node).Score)
 		}
 	}
 
@@ -302,6 +309,12 @@ func (ll *Sll) Remove(n *Node) {
 	atomic.AddUint64(&ll.len, ^uint64(0))
 }
 
+// Has returns whether or not
+// n is linked in the *Sll.
+func (ll *Sll) Has(n *Node) bool {
+	return n.list == ll && n.next != nil
+}
+
 // RemoveHead removes the current *Sll.head.
 func (ll *Sll) RemoveHead() {
 	ll.Remove(ll.root.prev)
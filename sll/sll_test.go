@@ -371,6 +371,59 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestHas(t *testing.T) {
+	s, other := sll.New(), sll.New()
+
+	node := s.PushTail("value")
+
+	if !s.Has(node) || other.Has(node) {
+		t.Error("Expected node to be linked only in s")
+	}
+
+	s.Remove(node)
+	other.PushHeadNode(node)
+
+	if s.Has(node) || !other.Has(node) {
+		t.Error("Expected node to be linked only in other")
+	}
+
+	other.Remove(node)
+
+	if other.Has(node) {
+		t.Error("Expected removed node to be unlinked")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := sll.New()
+
+	if s.Copy().Len() != 0 {
+		t.Error("Expected empty copy")
+	}
+
+	for i := 0; i < 5; i++ {
+		s.PushTail(i).Score = uint64(i)
+	}
+
+	c := s.Copy()
+
+	if c.Len() != 5 {
+		t.Fatalf("Expected len 5, got %d", c.Len())
+	}
+
+	for node, orig := c.Head(), s.Head(); node != nil; node, orig = node.Prev(), orig.Prev() {
+		if node == orig || node.Value != orig.Value || node.Score != orig.Score {
+			t.Errorf("Expected copy of node %v", orig.Value)
+		}
+
+		// Copies are linked in
+		// the new list only.
+		if !c.Has(node) || s.Has(node) {
+			t.Errorf("Expected node %v to be linked in the copy", node.Value)
+		}
+	}
+}
+
 func TestRemoveHead(t *testing.T) {
 	s := sll.New()
 